@@ -0,0 +1,66 @@
+package mobi
+
+import (
+	"errors"
+	"io"
+)
+
+// Book is a built MOBI book, as returned by Builder.Build. It does not change once built,
+// and can be written any number of times.
+type Book struct {
+	pdf     mobiPDF
+	records [][]byte
+}
+
+// WriteTo writes the book to out: the Palm database header, the record list and the records
+func (b *Book) WriteTo(out io.Writer) (n int64, err error) {
+	bw := &binaryWriter{out: out}
+	sizes := make([]int, len(b.records))
+	for i, rec := range b.records {
+		sizes[i] = len(rec)
+	}
+	if err = writeRecordList(bw, b.pdf, sizes); err != nil {
+		return bw.written(), err
+	}
+
+	for _, rec := range b.records {
+		if _, err = bw.Write(rec); err != nil {
+			return bw.written(), err
+		}
+	}
+	return bw.written(), nil
+}
+
+// writeRecordList writes the Palm database header and the list of records of the given sizes, which follow it
+func writeRecordList(bw *binaryWriter, pdf mobiPDF, sizes []int) error {
+	if len(sizes) > maxRecordCount {
+		return errors.New("Book has more than 65535 records")
+	}
+	if _, err := bw.writeBinary(pdf); err != nil {
+		return err
+	}
+
+	offset := uint32(recordListEnd(len(sizes)))
+	for i, size := range sizes {
+		if _, err := bw.writeBinary(mobiRecordOffset{Offset: offset, UniqueID: uint16(i)}); err != nil {
+			return err
+		}
+		offset += uint32(size)
+	}
+	_, err := bw.pad(2)
+	return err
+}
+
+// recordListEnd returns the offset of the first record of a book with count records
+func recordListEnd(count int) int {
+	return palmDBHeaderLen + count*8 + 2
+}
+
+// Size returns the size of the book in bytes
+func (b *Book) Size() int64 {
+	size := int64(recordListEnd(len(b.records)))
+	for _, rec := range b.records {
+		size += int64(len(rec))
+	}
+	return size
+}
@@ -2,58 +2,455 @@ package mobi
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"html"
+	"io"
+	"sync"
 )
 
-// Chapter lets you add sub-chapters to the book
+// Chapter is a chapter of the book. Chapters form a tree, every chapter can have sub-chapters of its own.
+// A Chapter stays valid while chapters are added, moved or removed.
 type Chapter interface {
 	AddSubChapter(title string, text []byte) Chapter
+	AddSubChapterReader(title string, r io.Reader) Chapter
+	AddSubChapterSource(title string, open func() (io.ReadCloser, error)) Chapter
+	NewSubChapter(title string, text []byte) Chapter
+	InsertBefore(title string, text []byte) (Chapter, error)
+	InsertAfter(title string, text []byte) (Chapter, error)
+
+	Remove() error
+	MoveBefore(sibling Chapter) error
+	MoveAfter(sibling Chapter) error
+	MoveInto(parent Chapter) error
+
+	Title() string
+	SetTitle(title string) Chapter
+	Content() []byte
+	SetContent(text []byte) Chapter
+	SetContentSource(open func() (io.ReadCloser, error)) Chapter
+	ID() string
+	SetID(id string) Chapter
+	SetFileName(name string) Chapter
+
+	Parent() Chapter
+	SubChapters() []Chapter
 }
 
 type mobiChapter struct {
-	ID           int
-	Parent       int
-	Title        string
+	Anchor       int // Number of the anchor written before top level chapters, which the TOC chapter links to
 	RecordOffset int
 	LabelOffset  int
 	Len          int
 	HTML         []byte
-	SubChapters  []*mobiChapter
+	source       func() (io.ReadCloser, error) // Opens the content when the book is built, used instead of HTML if set
+
+	title       string
+	subChapters []*mobiChapter
+	parent      *mobiChapter // Nil for top level chapters
+	book        *mobiBuilder // Set for top level chapters, nil once removed from the book
 
-	subChapter bool
+	id       string // Set by SetID, used by FindChapter
+	fileName string // Name used by links from other chapters, as in "name.html#id"
 }
 
 // NewChapter adds a new chapter to the output MobiBook
 func (w *mobiBuilder) NewChapter(title string, text []byte) Chapter {
-	w.chapters = append(w.chapters, mobiChapter{ID: w.chapterCount, Title: title, HTML: text})
-	w.chapterCount++
-	return &w.chapters[len(w.chapters)-1]
+	ch := &mobiChapter{title: title, HTML: text, book: w}
+	w.chapters = append(w.chapters, ch)
+	return ch
+}
+
+// NewChapterReader adds a new chapter whose content is read from r when the book is built. Readers which implement
+// io.Seeker are read again from their current position by later builds and by WriteStream, which reads chapters twice.
+// Other readers can only be read once, so their content is kept in memory once read. Use NewChapterSource for content
+// which is opened on demand.
+func (w *mobiBuilder) NewChapterReader(title string, r io.Reader) Chapter {
+	return w.NewChapterSource(title, readerSource(r))
+}
+
+// NewChapterSource adds a new chapter whose content is read from the reader returned by open, every time
+// the book is built. Open is not called before then, so files or query results are only opened while the book is written.
+func (w *mobiBuilder) NewChapterSource(title string, open func() (io.ReadCloser, error)) Chapter {
+	return w.NewChapter(title, nil).SetContentSource(open)
+}
+
+// Chapters returns the top level chapters of the book
+func (w *mobiBuilder) Chapters() []Chapter {
+	return chapterList(w.chapters)
+}
+
+// FindChapter returns the first chapter, in reading order, with the ID set by SetID. It returns nil if there is none.
+func (w *mobiBuilder) FindChapter(id string) Chapter {
+	for _, ch := range w.allChapters() {
+		if ch.id == id {
+			return ch
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for every chapter and sub-chapter in reading order, with the depth of the chapter
+// (0 for top level chapters). Walk stops at the first error returned by fn, and returns it.
+// The chapters are listed before fn is first called, so fn may change the tree.
+func (w *mobiBuilder) Walk(fn func(ch Chapter, depth int) error) error {
+	var walk func(chapters []*mobiChapter, depth int) error
+	walk = func(chapters []*mobiChapter, depth int) error {
+		for _, ch := range append([]*mobiChapter(nil), chapters...) {
+			if err := fn(ch, depth); err != nil {
+				return err
+			}
+			if err := walk(ch.subChapters, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(w.chapters, 0)
 }
 
 // AddSubChapter adds a sub-chapter to the Chapter and returns the parent chapter back again
 func (w *mobiChapter) AddSubChapter(title string, text []byte) Chapter {
-	w.SubChapters = append(w.SubChapters, &mobiChapter{Parent: w.ID, Title: title, HTML: text, subChapter: true})
+	w.NewSubChapter(title, text)
+	return w
+}
+
+// NewSubChapter adds a sub-chapter to the Chapter and returns the sub-chapter, so it can get sub-chapters of its own
+func (w *mobiChapter) NewSubChapter(title string, text []byte) Chapter {
+	sub := &mobiChapter{title: title, HTML: text, parent: w}
+	w.subChapters = append(w.subChapters, sub)
+	return sub
+}
+
+// AddSubChapterReader adds a sub-chapter whose content is read from r, as with NewChapterReader,
+// and returns the parent chapter back again
+func (w *mobiChapter) AddSubChapterReader(title string, r io.Reader) Chapter {
+	return w.AddSubChapterSource(title, readerSource(r))
+}
+
+// AddSubChapterSource adds a sub-chapter whose content is read from the reader returned by open,
+// as with NewChapterSource, and returns the parent chapter back again
+func (w *mobiChapter) AddSubChapterSource(title string, open func() (io.ReadCloser, error)) Chapter {
+	w.NewSubChapter(title, nil).SetContentSource(open)
+	return w
+}
+
+// InsertBefore adds a new chapter before this one, at the same level, and returns the new chapter.
+// It fails if this chapter was removed from the book.
+func (w *mobiChapter) InsertBefore(title string, text []byte) (Chapter, error) {
+	ch := &mobiChapter{title: title, HTML: text}
+	if err := w.insert(ch, 0); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// InsertAfter adds a new chapter after this one, at the same level, and returns the new chapter.
+// It fails if this chapter was removed from the book.
+func (w *mobiChapter) InsertAfter(title string, text []byte) (Chapter, error) {
+	ch := &mobiChapter{title: title, HTML: text}
+	if err := w.insert(ch, 1); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Remove removes the chapter, along with its sub-chapters, from the book.
+// It can be added back with one of the Move methods. It fails if the chapter was already removed.
+func (w *mobiChapter) Remove() error {
+	if w.index() < 0 {
+		return errors.New("Chapter is not part of a book")
+	}
+	w.detach()
+	return nil
+}
+
+// MoveBefore moves the chapter, along with its sub-chapters, before sibling
+func (w *mobiChapter) MoveBefore(sibling Chapter) error {
+	return w.moveTo(sibling, 0)
+}
+
+// MoveAfter moves the chapter, along with its sub-chapters, after sibling
+func (w *mobiChapter) MoveAfter(sibling Chapter) error {
+	return w.moveTo(sibling, 1)
+}
+
+// MoveInto moves the chapter, along with its sub-chapters, to the end of the sub-chapters of parent
+func (w *mobiChapter) MoveInto(parent Chapter) error {
+	p, ok := parent.(*mobiChapter)
+	if !ok {
+		return errors.New("Unknown chapter type")
+	}
+	if p.isWithin(w) {
+		return errors.New("Can not move a chapter into itself")
+	}
+
+	w.detach()
+	w.parent = p
+	p.subChapters = append(p.subChapters, w)
+	return nil
+}
+
+// moveTo moves the chapter next to sibling, before it if offset is 0 and after it if offset is 1
+func (w *mobiChapter) moveTo(sibling Chapter, offset int) error {
+	s, ok := sibling.(*mobiChapter)
+	if !ok {
+		return errors.New("Unknown chapter type")
+	}
+	if s.isWithin(w) {
+		return errors.New("Can not move a chapter next to itself or its sub-chapters")
+	}
+	if s.index() < 0 {
+		return errors.New("Chapter is not part of a book")
+	}
+
+	w.detach()
+	return s.insert(w, offset)
+}
+
+// Title returns the title of the chapter
+func (w *mobiChapter) Title() string {
+	return w.title
+}
+
+// SetTitle changes the title of the chapter and returns the chapter back again
+func (w *mobiChapter) SetTitle(title string) Chapter {
+	w.title = title
+	return w
+}
+
+// Content returns the HTML of the chapter. It is nil for chapters whose content is read from a source.
+func (w *mobiChapter) Content() []byte {
+	return w.HTML
+}
+
+// SetContent changes the HTML of the chapter and returns the chapter back again
+func (w *mobiChapter) SetContent(text []byte) Chapter {
+	w.HTML, w.source = text, nil
+	return w
+}
+
+// SetContentSource sets the content of the chapter to be read from the reader returned by open when the book is built.
+// It returns the chapter back again.
+func (w *mobiChapter) SetContentSource(open func() (io.ReadCloser, error)) Chapter {
+	w.HTML, w.source = nil, open
+	return w
+}
+
+// content returns the HTML of the chapter, reading it from its source if it has one
+func (w *mobiChapter) content() ([]byte, error) {
+	if w.source == nil {
+		return w.HTML, nil
+	}
+
+	rc, err := w.open()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(rc)
+	if closeErr := rc.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, errors.New("Can not read chapter " + w.title + ": " + err.Error())
+	}
+	return data, nil
+}
+
+// open returns a reader of the HTML of the chapter, opening its source if it has one
+func (w *mobiChapter) open() (io.ReadCloser, error) {
+	if w.source == nil {
+		return io.NopCloser(bytes.NewReader(w.HTML)), nil
+	}
+	rc, err := w.source()
+	if err != nil {
+		return nil, errors.New("Can not open chapter " + w.title + ": " + err.Error())
+	}
+	return rc, nil
+}
+
+// readerSource returns a source reading r. Readers which implement io.Seeker go back to their position
+// at the time of the call before every read but the first. Other readers can only be read once,
+// so they are read whole the first time and kept in memory for the reads after that.
+func readerSource(r io.Reader) func() (io.ReadCloser, error) {
+	var mu sync.Mutex
+	var start int64
+	var err error
+	seeker, seekable := r.(io.Seeker)
+	if seekable {
+		start, err = seeker.Seek(0, io.SeekCurrent)
+	}
+	read := false
+	var kept []byte
+	return func() (io.ReadCloser, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err != nil:
+			return nil, err
+		case !seekable:
+			if !read {
+				read = true
+				if kept, err = io.ReadAll(r); err != nil {
+					return nil, err
+				}
+			}
+			return io.NopCloser(bytes.NewReader(kept)), nil
+		case read:
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		read = true
+		return io.NopCloser(r), nil
+	}
+}
+
+// ID returns the ID set by SetID
+func (w *mobiChapter) ID() string {
+	return w.id
+}
+
+// SetID sets an ID to find the chapter with FindChapter, and returns the chapter back again.
+// The ID is not written to the book.
+func (w *mobiChapter) SetID(id string) Chapter {
+	w.id = id
 	return w
 }
 
+// SetFileName sets the file name other chapters use to link to this chapter, such as "chapter1.html".
+// It returns the chapter back again.
+func (w *mobiChapter) SetFileName(name string) Chapter {
+	w.fileName = name
+	return w
+}
+
+// Parent returns the chapter this chapter is a sub-chapter of, or nil for top level chapters
+func (w *mobiChapter) Parent() Chapter {
+	if w.parent == nil {
+		return nil
+	}
+	return w.parent
+}
+
+// SubChapters returns the sub-chapters of the chapter
+func (w *mobiChapter) SubChapters() []Chapter {
+	return chapterList(w.subChapters)
+}
+
 // Number of sub-chapters in this chapter
 func (w *mobiChapter) SubChapterCount() int {
-	return len(w.SubChapters)
+	return len(w.subChapters)
 }
 
-func (w *mobiChapter) generateHTML(out *bytes.Buffer) {
-	//Add check for unsupported HTML tags, characters, clean up HTML
+// siblings returns the list holding the chapter: the sub-chapters of its parent or the top level
+// chapters of the book. It returns nil for removed chapters.
+func (w *mobiChapter) siblings() *[]*mobiChapter {
+	switch {
+	case w.parent != nil:
+		return &w.parent.subChapters
+	case w.book != nil:
+		return &w.book.chapters
+	}
+	return nil
+}
+
+// index returns the position of the chapter in its siblings, or -1 for removed chapters
+func (w *mobiChapter) index() int {
+	list := w.siblings()
+	if list == nil {
+		return -1
+	}
+	for i, ch := range *list {
+		if ch == w {
+			return i
+		}
+	}
+	return -1
+}
+
+// insert adds ch to the siblings of the chapter, before it if offset is 0 and after it if offset is 1
+func (w *mobiChapter) insert(ch *mobiChapter, offset int) error {
+	i := w.index()
+	if i < 0 {
+		return errors.New("Chapter is not part of a book")
+	}
+
+	i += offset
+	list := w.siblings()
+	*list = append(*list, nil)
+	copy((*list)[i+1:], (*list)[i:])
+	(*list)[i] = ch
+	ch.parent, ch.book = w.parent, w.book
+	return nil
+}
+
+// detach takes the chapter out of its siblings, if it has any
+func (w *mobiChapter) detach() {
+	if i := w.index(); i >= 0 {
+		list := w.siblings()
+		*list = append((*list)[:i], (*list)[i+1:]...)
+	}
+	w.parent, w.book = nil, nil
+}
+
+// isWithin reports whether the chapter is ch or one of its sub-chapters
+func (w *mobiChapter) isWithin(ch *mobiChapter) bool {
+	for p := w; p != nil; p = p.parent {
+		if p == ch {
+			return true
+		}
+	}
+	return false
+}
+
+func chapterList(chapters []*mobiChapter) []Chapter {
+	out := make([]Chapter, len(chapters))
+	for i, ch := range chapters {
+		out[i] = ch
+	}
+	return out
+}
+
+// generateHTML writes the text of the chapter, without its sub-chapters, and records where it is in out
+func (w *mobiChapter) generateHTML(out *bytes.Buffer, content []byte) {
 	w.RecordOffset = out.Len()
-	Len0 := out.Len()
-	if !w.subChapter {
+	w.writeHTML(out, content)
+	w.Len = out.Len() - w.RecordOffset
+}
+
+// chapterEnd ends the text of every chapter
+const chapterEnd = "<mbp:pagebreak/>"
+
+// writeHTML writes the text of the chapter, without its sub-chapters, with the given content
+func (w *mobiChapter) writeHTML(out *bytes.Buffer, content []byte) {
+	w.writeHTMLStart(out)
+	out.Write(content)
+	out.WriteString(chapterEnd)
+}
+
+// writeHTMLStart writes the text of the chapter which comes before its content
+func (w *mobiChapter) writeHTMLStart(out *bytes.Buffer) {
+	//Add check for unsupported HTML tags, characters, clean up HTML
+	if w.parent == nil {
 		// main chapter, write TOC target
-		out.WriteString(fmt.Sprintf("<a name='%d' id='%d'></a>", w.ID, w.ID))
+		out.WriteString(fmt.Sprintf("<a name='%d' id='%d'></a>", w.Anchor, w.Anchor))
+	}
+	out.WriteString("<h1>" + html.EscapeString(w.title) + "</h1>")
+}
+
+// allChapters lists the chapters and sub-chapters of the book in reading order
+func (w *mobiBuilder) allChapters() []*mobiChapter {
+	var chapters []*mobiChapter
+	var walk func(ch *mobiChapter)
+	walk = func(ch *mobiChapter) {
+		chapters = append(chapters, ch)
+		for _, sub := range ch.subChapters {
+			walk(sub)
+		}
 	}
-	out.WriteString("<h1>" + w.Title + "</h1>")
-	out.Write(w.HTML)
-	out.WriteString("<mbp:pagebreak/>")
-	w.Len = out.Len() - Len0
-	for i := range w.SubChapters {
-		w.SubChapters[i].generateHTML(out)
+	for _, ch := range w.chapters {
+		walk(ch)
 	}
+	return chapters
 }
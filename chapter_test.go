@@ -0,0 +1,176 @@
+package mobi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChapterTree(t *testing.T) {
+	m := NewBuilder()
+	ch1 := m.NewChapter("Chapter 1", nil).SetID("ch1")
+	ch3 := m.NewChapter("Chapter 3", nil)
+	ch1.NewSubChapter("Section 1.1", nil).SetID("s11")
+
+	// Handles stay valid after more chapters are added
+	ch1.AddSubChapter("Section 1.2", nil)
+	ch2, err := ch3.InsertBefore("Chapter 2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch2.AddSubChapter("Section 2.1", nil)
+	appendix, _ := ch3.InsertAfter("Appendix", nil)
+	appendix.SetID("appendix")
+	s115, _ := m.FindChapter("s11").InsertAfter("Section 1.1b", nil)
+	s115.SetTitle("Section 1.1.5").SetContent([]byte("<p>Late</p>"))
+
+	if err := m.FindChapter("appendix").MoveBefore(ch1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.FindChapter("appendix").MoveInto(ch3); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch1.MoveInto(m.FindChapter("s11")); err == nil {
+		t.Error("Chapter was moved into its own sub-chapter")
+	}
+	if err := m.Chapters()[1].SubChapters()[0].Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	m.Walk(func(ch Chapter, depth int) error {
+		got = append(got, strings.Repeat("-", depth)+ch.Title())
+		return nil
+	})
+	expected := []string{"Chapter 1", "-Section 1.1", "-Section 1.1.5", "-Section 1.2", "Chapter 2", "Chapter 3", "-Appendix"}
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected chapters %v, got %v", expected, got)
+	}
+
+	if m.FindChapter("appendix").Parent() != ch3 || ch1.Parent() != nil {
+		t.Error("Unexpected parent chapters")
+	}
+	if string(ch1.SubChapters()[1].Content()) != "<p>Late</p>" || m.FindChapter("missing") != nil {
+		t.Error("Unexpected chapter lookup")
+	}
+}
+
+func TestRemovedChapter(t *testing.T) {
+	m := NewBuilder()
+	ch1 := m.NewChapter("Chapter 1", nil)
+	ch2 := m.NewChapter("Chapter 2", nil)
+	section := ch2.NewSubChapter("Section 2.1", nil)
+	m.NewChapter("Chapter 3", nil)
+
+	if err := ch2.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch2.Remove(); err == nil {
+		t.Error("Chapter was removed twice")
+	}
+	if ch, err := ch2.InsertBefore("Before", nil); err == nil || ch != nil {
+		t.Error("Chapter was inserted next to a removed chapter")
+	}
+	if _, err := ch2.InsertAfter("After", nil); err == nil {
+		t.Error("Chapter was inserted next to a removed chapter")
+	}
+	if err := ch1.MoveAfter(ch2); err == nil {
+		t.Error("Chapter was moved next to a removed chapter")
+	}
+
+	// Sub-chapters stay with the removed chapter, and it can be added back
+	if _, err := section.InsertAfter("Section 2.2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch2.MoveAfter(ch1); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	m.Walk(func(ch Chapter, depth int) error {
+		got = append(got, strings.Repeat("-", depth)+ch.Title())
+		return nil
+	})
+	expected := []string{"Chapter 1", "Chapter 2", "-Section 2.1", "-Section 2.2", "Chapter 3"}
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected chapters %v, got %v", expected, got)
+	}
+}
+
+// resolverFunc resolves images with a function
+type resolverFunc func(src string) ([]byte, error)
+
+func (f resolverFunc) Resolve(src string) ([]byte, error) {
+	return f(src)
+}
+
+func TestChapterSources(t *testing.T) {
+	opened := 0
+	open := func() (io.ReadCloser, error) {
+		opened++
+		return io.NopCloser(strings.NewReader("<p>From source</p>")), nil
+	}
+
+	sub := strings.NewReader("skip<p>Sub reader</p>")
+	sub.Seek(4, io.SeekStart)
+	m := NewBuilder()
+	m.Title("Sources")
+	m.NewChapterReader("Chapter 1", strings.NewReader("<p>From reader</p>")).
+		AddSubChapterSource("Chapter 1-1", open)
+	m.NewChapter("Chapter 2", []byte("<p>Bytes</p>")).AddSubChapterReader("Chapter 2-1", sub)
+	if opened != 0 {
+		t.Error("Source was opened before the book was built")
+	}
+
+	// Seekable readers are read again from where they were, sources are opened again
+	for i := 1; i <= 2; i++ {
+		built, _ := writeTestBook(t, m.(*mobiBuilder))
+		html := built.bookHTML.String()
+		for _, text := range []string{"From reader", "From source", "Bytes", "Sub reader"} {
+			if !strings.Contains(html, text) {
+				t.Errorf("Build %d: missing chapter content %q", i, text)
+			}
+		}
+		if strings.Contains(html, "skip") {
+			t.Errorf("Build %d: reader was read from its start", i)
+		}
+		if opened != i {
+			t.Errorf("Build %d: source opened %d times", i, opened)
+		}
+	}
+
+	// Other readers are only read once, and kept for later builds
+	m.NewChapterReader("Chapter 3", bytes.NewBufferString("<p>Once</p>"))
+	for i := 1; i <= 2; i++ {
+		built, _ := writeTestBook(t, m.(*mobiBuilder))
+		if !strings.Contains(built.bookHTML.String(), "<p>Once</p>") {
+			t.Errorf("Build %d: missing content of a reader which is not seekable", i)
+		}
+	}
+
+	// Sources are opened in reading order, each one when its text is written
+	var order []string
+	m = NewBuilder()
+	m.ImageResolver(resolverFunc(func(src string) ([]byte, error) {
+		order = append(order, src)
+		return []byte("GIF89a"), nil
+	}))
+	for _, title := range []string{"Chapter 1", "Chapter 2"} {
+		title := title
+		m.NewChapterSource(title, func() (io.ReadCloser, error) {
+			order = append(order, title)
+			return io.NopCloser(strings.NewReader(`<p><img src="` + title + `.gif"></p>`)), nil
+		}).AddSubChapterSource(title+"-1", func() (io.ReadCloser, error) {
+			order = append(order, title+"-1")
+			return nil, errors.New("Gone")
+		})
+	}
+	if _, err := m.Build(); err == nil || !strings.Contains(err.Error(), "Gone") {
+		t.Errorf("Source error was not returned: %v", err)
+	}
+	if strings.Join(order, ",") != "Chapter 1,Chapter 1.gif,Chapter 1-1" {
+		t.Errorf("Unexpected sources opened: %v", order)
+	}
+}
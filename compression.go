@@ -1,6 +1,10 @@
 package mobi
 
-import "bytes"
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+)
 
 // CompressionStrategy is an enum of available compression strategies to use
 type CompressionStrategy int
@@ -10,24 +14,37 @@ const (
 	CompressFast = CompressionStrategy(iota)
 	// CompressLowMemory uses a slower, but less memory intensive compression
 	CompressLowMemory
+	// CompressBest picks the smallest encoding of every record, at the cost of a slower compression
+	CompressBest
 )
 
-// The main entry point to using the palmLZ77 compression
-// The exact speed is controlled at a module level through SetCompressionStrategy
-var palmLZ77Compress func([]byte) []byte
+// compressDefault is the strategy of builders which did not pick one, they use the package default
+const compressDefault = CompressionStrategy(-1)
+
+// defaultStrategy is the strategy used by builders which did not pick one
+var defaultStrategy atomic.Int32
 
-// SetCompressionStrategy picks the compression strategy to use
+// SetCompressionStrategy picks the compression strategy of builders which do not pick their own
+// with Builder.CompressionStrategy. It can be called while books are built.
 func SetCompressionStrategy(strategy CompressionStrategy) {
-	switch strategy {
-	case CompressFast:
-		palmLZ77Compress = func(data []byte) []byte { return palmLZ77CompressWithResolver(data, newLZ77TreeResolver) }
-	case CompressLowMemory:
-		palmLZ77Compress = func(data []byte) []byte { return palmLZ77CompressWithResolver(data, newLZ77LookupResolver) }
+	if strategy.valid() {
+		defaultStrategy.Store(int32(strategy))
 	}
 }
 
-func init() {
-	SetCompressionStrategy(CompressFast)
+func (s CompressionStrategy) valid() bool {
+	return s == CompressFast || s == CompressLowMemory || s == CompressBest
+}
+
+// palmLZ77Compress is the main entry point to using the palmLZ77 compression, with the given strategy
+func palmLZ77Compress(data []byte, strategy CompressionStrategy) []byte {
+	switch strategy {
+	case CompressLowMemory:
+		return palmLZ77CompressWithResolver(data, newLZ77LookupResolver)
+	case CompressBest:
+		return palmLZ77CompressBest(data)
+	}
+	return palmLZ77CompressWithResolver(data, newLZ77TreeResolver)
 }
 
 func palmLZ77CompressWithResolver(data []byte, resolverProvider func([]byte) lz77Resolver) []byte {
@@ -120,6 +137,48 @@ func palmLZ77CompressWithResolver(data []byte, resolverProvider func([]byte) lz7
 	return outB
 }
 
+// palmLZ77Decompress expands a PalmDoc LZ77 compressed record. Trailing entries must be stripped beforehand.
+func palmLZ77Decompress(data []byte) ([]byte, error) {
+	out := make([]byte, 0, maxRecordSize)
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == 0 || (c > 8 && c < 0x80):
+			// A single-byte character
+			out = append(out, c)
+		case c <= 8:
+			// c bytes follow as-is
+			if i+int(c) >= len(data) {
+				return nil, errors.New("LZ77 literal run exceeds record size")
+			}
+			out = append(out, data[i+1:i+1+int(c)]...)
+			i += int(c)
+		case c < 0xC0:
+			// Two-byte structure: 11 bits of distance and 3 bits of length
+			if i+1 >= len(data) {
+				return nil, errors.New("LZ77 back-reference exceeds record size")
+			}
+			code := (int(c)<<8 | int(data[i+1])) & 0x3FFF
+			i++
+			dist := code >> 3
+			length := code&0x07 + lz77MinChunkLen
+			if dist == 0 || dist > len(out) {
+				return nil, errors.New("LZ77 back-reference points outside of decoded data")
+			}
+			// Copy byte by byte since the chunk may overlap with what is being written
+			start := len(out) - dist
+			for j := 0; j < length; j++ {
+				out = append(out, out[start+j])
+			}
+		default:
+			// Space followed by an ascii character
+			out = append(out, chSpace, c^0x80)
+		}
+	}
+	return out, nil
+}
+
 // lz77Resolver objects can find a chunk in their data store between the min and max indices
 type lz77Resolver interface {
 	// findChunk finds the provided chunk between the idxMin and idxMax indices
@@ -0,0 +1,139 @@
+package mobi
+
+// Sizes, in bytes, of the PalmDoc LZ77 codes
+const (
+	lz77LiteralCost = 1 // Plain ASCII character, or a space followed by an ASCII letter
+	lz77MatchCost   = 2 // Back-reference into the window
+	lz77RunMax      = 8 // Longest run of bytes copied as is, which costs one byte more than its length
+)
+
+// lz77Step is the last code of the cheapest encoding of the data up to a position
+type lz77Step struct {
+	cost int // Size of the encoded data up to this position
+	from int // Position the code starts at
+	dist int // Distance of a back-reference, 0 for other codes
+}
+
+// palmLZ77CompressBest compresses a record like palmLZ77CompressWithResolver, but picks the
+// cheapest sequence of codes for the whole record instead of the longest match at each position.
+// Back-references are used anywhere in the record, for all lengths from 3 to 10.
+func palmLZ77CompressBest(data []byte) []byte {
+	// The tail, along with its length in the last byte, is kept as is
+	tailLen := int(data[len(data)-1])
+	tail := data[(len(data)-1)-tailLen:]
+	data = data[:(len(data)-1)-tailLen]
+
+	n := len(data)
+	steps := make([]lz77Step, n+1)
+	for i := 1; i <= n; i++ {
+		steps[i].cost = -1
+	}
+	relax := func(to, from, cost, dist int) {
+		if s := &steps[to]; s.cost < 0 || cost < s.cost {
+			*s = lz77Step{cost: cost, from: from, dist: dist}
+		}
+	}
+
+	matches := newLZ77MatchFinder(data)
+	for i := 0; i < n; i++ {
+		cost := steps[i].cost
+		c := data[i]
+
+		if c == 0 || (c > 8 && c < 0x80) {
+			relax(i+1, i, cost+lz77LiteralCost, 0)
+		}
+		if c == chSpace && i+1 < n && data[i+1] >= 0x40 && data[i+1] < 0x80 {
+			relax(i+2, i, cost+lz77LiteralCost, 0)
+		}
+		for run := 1; run <= lz77RunMax && i+run <= n; run++ {
+			relax(i+run, i, cost+1+run, 0)
+		}
+
+		// Any shorter prefix of the longest match is a match at the same distance
+		if dist, length := matches.longest(i); dist > 0 {
+			for l := lz77MinChunkLen; l <= length; l++ {
+				relax(i+l, i, cost+lz77MatchCost, dist)
+			}
+		}
+	}
+
+	// Follow the cheapest path back from the end, then write its codes in order
+	var path []int
+	for i := n; i > 0; i = steps[i].from {
+		path = append(path, i)
+	}
+
+	out := make([]byte, 0, steps[n].cost+len(tail))
+	start := 0
+	for p := len(path) - 1; p >= 0; p-- {
+		end := path[p]
+		switch length := end - start; {
+		case steps[end].dist > 0:
+			code := 0x8000 + steps[end].dist<<3 + (length - lz77MinChunkLen)
+			out = append(out, byte(code>>8), byte(code))
+		case length == 2 && data[start] == chSpace && steps[end].cost-steps[start].cost == lz77LiteralCost:
+			out = append(out, data[start+1]^0x80)
+		case steps[end].cost-steps[start].cost == lz77LiteralCost:
+			out = append(out, data[start])
+		default:
+			out = append(out, byte(length))
+			out = append(out, data[start:end]...)
+		}
+		start = end
+	}
+	return append(out, tail...)
+}
+
+// lz77MatchFinder finds the longest back-reference at a position, using chains of
+// earlier positions which start with the same 3 bytes
+type lz77MatchFinder struct {
+	data []byte
+	head map[[3]byte]int // Last position of every 3 byte prefix seen so far
+	prev []int           // Previous position with the same prefix, -1 if none
+	next int             // Positions below next are in the chains
+}
+
+func newLZ77MatchFinder(data []byte) *lz77MatchFinder {
+	prev := make([]int, len(data))
+	return &lz77MatchFinder{data: data, head: make(map[[3]byte]int), prev: prev}
+}
+
+// longest returns the distance and length of the longest match at position i, or 0, 0 if there is none.
+// Positions must be asked for in increasing order. Of matches of the same length, the closest one is returned.
+func (f *lz77MatchFinder) longest(i int) (dist, length int) {
+	for ; f.next < i && f.next+lz77MinChunkLen <= len(f.data); f.next++ {
+		key := [3]byte{f.data[f.next], f.data[f.next+1], f.data[f.next+2]}
+		if last, ok := f.head[key]; ok {
+			f.prev[f.next] = last
+		} else {
+			f.prev[f.next] = -1
+		}
+		f.head[key] = f.next
+	}
+
+	if i+lz77MinChunkLen > len(f.data) {
+		return 0, 0
+	}
+	maxLen := len(f.data) - i
+	if maxLen > lz77MaxChunkLen {
+		maxLen = lz77MaxChunkLen
+	}
+
+	key := [3]byte{f.data[i], f.data[i+1], f.data[i+2]}
+	pos, ok := f.head[key]
+	for ok && pos >= 0 && i-pos <= lz77WindowSize {
+		// The match may run into position i itself, the decoder copies byte by byte
+		l := lz77MinChunkLen
+		for l < maxLen && f.data[pos+l] == f.data[i+l] {
+			l++
+		}
+		if l > length {
+			dist, length = i-pos, l
+			if l == maxLen {
+				break
+			}
+		}
+		pos = f.prev[pos]
+	}
+	return dist, length
+}
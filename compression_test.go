@@ -2,6 +2,8 @@ package mobi
 
 import (
 	"bytes"
+	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -33,6 +35,30 @@ func TestCorrectness(t *testing.T) {
 	}
 }
 
+func TestBestLZ77(t *testing.T) {
+	binary := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(binary)
+	inputs := map[string][]byte{
+		"text":       testData(),
+		"repetitive": append(bytes.Repeat([]byte("abcabcabd "), 400), 0),
+		"binary":     append(binary, 0),
+		"spaces":     append([]byte(strings.Repeat(" A \x01 \xff  ", 300)), 0),
+	}
+	for name, input := range inputs {
+		best := palmLZ77CompressBest(input)
+		out, err := palmLZ77Decompress(best)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(out, input) {
+			t.Errorf("%s: decompressed data differs from the input", name)
+		}
+		if fast := palmLZ77CompressWithResolver(input, newLZ77TreeResolver); len(best) > len(fast) {
+			t.Errorf("%s: best compression is larger than the fast one: %d > %d", name, len(best), len(fast))
+		}
+	}
+}
+
 var devnull []byte
 
 func BenchmarkLZ77(b *testing.B) {
@@ -53,6 +79,15 @@ func BenchmarkFastLZ77(b *testing.B) {
 	devnull = res
 }
 
+func BenchmarkBestLZ77(b *testing.B) {
+	input := testData()
+	var res []byte
+	for n := 0; n < b.N; n++ {
+		res = palmLZ77CompressBest(input)
+	}
+	devnull = res
+}
+
 func testData() []byte {
 	data := []byte(lipsum)
 	// Adding a zero byte to indicate that we don't have a tail
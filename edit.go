@@ -0,0 +1,279 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// EditMetadata changes the metadata of the book at path. Edit is called with the current metadata of the book,
+// and the changes it makes are written to record 0 (and to KF8 record 0 of joint books). All other records,
+// including the text, are copied unchanged. The book is written to a temporary file, which then replaces the original.
+func EditMetadata(path string, edit func(*Metadata)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	r, err := NewReaderFrom(file, stat.Size())
+	if err != nil {
+		return err
+	}
+	if err = r.Parse(); err != nil {
+		return err
+	}
+
+	old, err := r.Metadata()
+	if err != nil {
+		return err
+	}
+	m := *old
+	m.Authors = append([]string(nil), old.Authors...)
+	m.Subjects = append([]string(nil), old.Subjects...)
+	edit(&m)
+
+	// Records which are rewritten, by record number
+	changed := make(map[uint32][]byte)
+
+	rec, err := r.editRecord0(0, &r.mobi.Header, r.mobi.Exth, old, &m)
+	if err != nil {
+		return err
+	}
+	changed[0] = rec
+
+	if kf8 := r.mobi.KF8; kf8 != nil && kf8.Base != 0 {
+		if rec, err = r.editRecord0(kf8.Base, &kf8.Header, kf8.Exth, old, &m); err != nil {
+			return err
+		}
+		changed[kf8.Base] = rec
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = r.writeEdited(tmp, changed); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(stat.Mode()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	file.Close()
+	return os.Rename(tmp.Name(), path)
+}
+
+// editRecord0 rebuilds record 0 of the book part at record N with the edited metadata. The MOBI header
+// is kept, apart from the full name fields. The record keeps its size if the new EXTH still fits.
+func (r *Reader) editRecord0(n uint32, header *mobiHeader, exth mobiExth, old, m *Metadata) ([]byte, error) {
+	rec, err := r.readRecord(n)
+	if err != nil {
+		return nil, err
+	}
+
+	headerEnd := palmDocHeaderLen + int(header.HeaderLength)
+	if headerEnd > len(rec) {
+		return nil, errors.New("MOBI header is out of record bounds")
+	}
+
+	title := []byte(old.Title)
+	if start, end := int(header.FullNameOffset), int(header.FullNameOffset+header.FullNameLength); start <= end && end <= len(rec) {
+		title = rec[start:end]
+	}
+
+	exth.Records = append([]mobiExthRecord(nil), exth.Records...)
+	if m.Title != old.Title {
+		title = r.encodeString(m.Title)
+		if _, ok := exth.Value(EXTH_UPDATEDTITLE); ok {
+			exth.remove(EXTH_UPDATEDTITLE)
+			if err := exth.Add(EXTH_UPDATEDTITLE, title); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := r.applyMetadata(&exth, old, m); err != nil {
+		return nil, err
+	}
+
+	h := *header
+	h.ExthFlags |= 0x40
+
+	buf := new(bytes.Buffer)
+	bw := &binaryWriter{out: buf}
+	buf.Write(rec[:headerEnd])
+	if err := writeExth(bw, &exth); err != nil {
+		return nil, err
+	}
+	if _, err := bw.pad(1); err != nil {
+		return nil, err
+	}
+
+	h.FullNameOffset = uint32(buf.Len())
+	h.FullNameLength = uint32(len(title))
+	buf.Write(title)
+	if _, err := bw.pad(uint(padding4(buf.Len()))); err != nil {
+		return nil, err
+	}
+
+	// The header struct may be longer than a short header, so only its own bytes are replaced
+	headerBuf := new(bytes.Buffer)
+	if err := binary.Write(headerBuf, binary.BigEndian, h); err != nil {
+		return nil, err
+	}
+	out := buf.Bytes()
+	copy(out[palmDocHeaderLen:headerEnd], headerBuf.Bytes())
+
+	if len(out) < len(rec) {
+		out = append(out, make([]byte, len(rec)-len(out))...)
+	}
+	return out, nil
+}
+
+// applyMetadata updates the EXTH records of the fields changed from old to m
+func (r *Reader) applyMetadata(exth *mobiExth, old, m *Metadata) error {
+	// add keeps the first error, so the fields can be set one after the other
+	var err error
+	add := func(recType uint32, value interface{}) {
+		if err == nil {
+			err = exth.Add(recType, value)
+		}
+	}
+
+	setStrings := func(recType uint32, oldValues, values []string) {
+		if reflect.DeepEqual(oldValues, values) {
+			return
+		}
+		exth.remove(recType)
+		for _, v := range values {
+			if v != "" {
+				add(recType, r.encodeString(v))
+			}
+		}
+	}
+	setString := func(recType uint32, oldValue, value string) {
+		setStrings(recType, []string{oldValue}, []string{value})
+	}
+
+	setStrings(EXTH_AUTHOR, old.Authors, m.Authors)
+	setString(EXTH_PUBLISHER, old.Publisher, m.Publisher)
+	setString(EXTH_DESCRIPTION, old.Description, m.Description)
+	setString(EXTH_ISBN, old.ISBN, m.ISBN)
+	setStrings(EXTH_SUBJECT, old.Subjects, m.Subjects)
+	setString(EXTH_LANGUAGE, old.Language, m.Language)
+	setString(EXTH_DOCTYPE, old.DocType, m.DocType)
+
+	if m.ASIN != old.ASIN {
+		setString(EXTH_ASIN, old.ASIN, m.ASIN)
+		if _, ok := exth.Value(EXTH_ASIN504); ok {
+			setString(EXTH_ASIN504, old.ASIN, m.ASIN)
+		}
+	}
+
+	if !m.PublishingDate.Equal(old.PublishingDate) {
+		exth.remove(EXTH_PUBLISHINGDATE)
+		if !m.PublishingDate.IsZero() {
+			add(EXTH_PUBLISHINGDATE, m.PublishingDate.Format(time.RFC3339))
+		}
+	}
+
+	if m.CoverOffset != old.CoverOffset {
+		exth.remove(EXTH_COVEROFFSET)
+		exth.remove(EXTH_KF8COVERURI)
+		if m.CoverOffset >= 0 {
+			add(EXTH_COVEROFFSET, m.CoverOffset)
+			add(EXTH_KF8COVERURI, "kindle:embed:"+toBase32(m.CoverOffset+1, 4))
+		}
+	}
+	return err
+}
+
+// encodeString converts a string to the book's encoding
+func (r *Reader) encodeString(s string) []byte {
+	if r.mobi.Header.TextEncoding == EncCP1252 {
+		return encodeCP1252(s)
+	}
+	return []byte(s)
+}
+
+// writeEdited writes the book to out, replacing the changed records and moving the following records as needed
+func (r *Reader) writeEdited(out io.Writer, changed map[uint32][]byte) error {
+	count := uint32(r.mobi.Pdf.RecordsNum)
+	sizes := make([]uint32, count)
+	for n := uint32(0); n < count; n++ {
+		size, err := r.OffsetToRecord(n)
+		if err != nil {
+			return err
+		}
+		sizes[n] = size
+		if rec, ok := changed[n]; ok {
+			sizes[n] = uint32(len(rec))
+		}
+	}
+
+	bw := &binaryWriter{out: out}
+	pdf := r.mobi.Pdf
+	pdf.ModificationTime = uint32(time.Now().Unix())
+	if _, err := bw.writeBinary(pdf); err != nil {
+		return err
+	}
+
+	offset := r.mobi.Offsets[0].Offset
+	for n := uint32(0); n < count; n++ {
+		entry := r.mobi.Offsets[n]
+		entry.Offset = offset
+		if _, err := bw.writeBinary(entry); err != nil {
+			return err
+		}
+		offset += sizes[n]
+	}
+
+	// Keep whatever lies between the record list and record 0, usually two bytes of padding
+	gap := int64(r.mobi.Offsets[0].Offset) - int64(palmDBHeaderLen+8*count)
+	if gap > 0 {
+		if _, err := r.file.Seek(int64(palmDBHeaderLen+8*count), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(bw, r.file, gap); err != nil {
+			return err
+		}
+	}
+
+	for n := uint32(0); n < count; n++ {
+		if rec, ok := changed[n]; ok {
+			if _, err := bw.Write(rec); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := r.file.Seek(int64(r.mobi.Offsets[n].Offset), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(bw, r.file, int64(sizes[n])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
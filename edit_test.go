@@ -0,0 +1,127 @@
+package mobi
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEditMetadata(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "cover.jpg"), []byte("\xFF\xD8\xFF\xE0cover"), 0644)
+	os.WriteFile(filepath.Join(dir, "thumbnail.gif"), []byte("GIF89athumbnail"), 0644)
+
+	m := NewBuilder()
+	m.Title("Before")
+	m.Compression(CompressionPalmDoc)
+	m.KF8(true)
+	m.AddCover(filepath.Join(dir, "cover.jpg"), filepath.Join(dir, "thumbnail.gif"))
+	m.NewExthRecord(EXTH_DOCTYPE, "PDOC")
+	m.NewExthRecord(EXTH_AUTHOR, "Old Author")
+	m.NewExthRecord(EXTH_PUBLISHER, "Publisher")
+	m.NewChapter("Chapter 1", []byte(strings.Repeat(lipsum, 5)))
+
+	path := filepath.Join(dir, "book.mobi")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	before, err := NewReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := before.RawML()
+	parts, _ := before.KF8Parts()
+
+	// A long description does not fit the space reserved in record 0, so the following records move
+	description := strings.Repeat("Description. ", 2000)
+	err = EditMetadata(path, func(meta *Metadata) {
+		meta.Title = "After"
+		meta.Authors = []string{"New Author", "Second Author"}
+		meta.ASIN = "B000000000"
+		meta.DocType = "EBOK"
+		meta.Description = description
+		meta.CoverOffset = 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := r.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "After" || meta.ASIN != "B000000000" || meta.DocType != "EBOK" || meta.Description != description {
+		t.Errorf("Metadata was not changed: %+v", meta)
+	}
+	if strings.Join(meta.Authors, ",") != "New Author,Second Author" || meta.Publisher != "Publisher" {
+		t.Errorf("Unexpected authors %v or publisher %q", meta.Authors, meta.Publisher)
+	}
+
+	cover, err := r.Cover()
+	if err != nil || cover == nil || cover.Format != ImageGIF {
+		t.Errorf("Cover offset was not changed: %+v, %v", cover, err)
+	}
+
+	raw, err := r.RawML()
+	if err != nil || !bytes.Equal(raw, text) {
+		t.Errorf("Text changed after editing metadata: %v", err)
+	}
+
+	if asin, _ := r.mobi.KF8.Exth.Value(EXTH_ASIN); string(asin) != "B000000000" {
+		t.Errorf("KF8 record 0 was not changed, ASIN is %q", asin)
+	}
+	kf8Parts, err := r.KF8Parts()
+	if err != nil || len(kf8Parts) != len(parts) || !bytes.Equal(kf8Parts[0], parts[0]) {
+		t.Errorf("KF8 text changed after editing metadata: %v", err)
+	}
+
+	// kindle:embed indexes are base 32
+	if err = EditMetadata(path, func(meta *Metadata) { meta.CoverOffset = 9 }); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = NewReader(path); err != nil {
+		t.Fatal(err)
+	}
+	if uri, _ := r.mobi.Exth.Value(EXTH_KF8COVERURI); string(uri) != "kindle:embed:000A" {
+		t.Errorf("Unexpected cover URI %q", uri)
+	}
+}
+
+// stoppingWriter fails once more than limit bytes are written, and counts the writes tried after that
+type stoppingWriter struct {
+	failingWriter
+	after int
+}
+
+func (w *stoppingWriter) Write(p []byte) (int, error) {
+	n, err := w.failingWriter.Write(p)
+	if err != nil {
+		w.after++
+	}
+	return n, err
+}
+
+func TestEditMetadataWriteError(t *testing.T) {
+	_, data := buildTestBook(t, CompressionNone)
+	r := openTestBook(t, data)
+
+	// Fail both in the header and in the record list, the first error must stop the writing
+	for _, limit := range []int{10, 80} {
+		w := &stoppingWriter{failingWriter: failingWriter{limit: limit}}
+		if err := r.writeEdited(w, nil); err == nil || w.after != 1 {
+			t.Errorf("Write error after %d bytes was not returned at once: %d failed writes, error %v", limit, w.after, err)
+		}
+	}
+}
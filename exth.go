@@ -1,5 +1,10 @@
 package mobi
 
+import (
+	"errors"
+	"strconv"
+)
+
 // ExthType is type of EXTH record. If it's Binary/Numberic then read/write
 // it using BigEndian, String is read/write using LittleEndian
 type ExthType uint32
@@ -201,26 +206,35 @@ func (e *mobiExth) GetHeaderLenght() int {
 		elen += int(k.RecordLength)
 	}
 
-	Padding := elen % 4
-	elen += Padding
+	elen += padding4(elen)
 
 	return elen
 }
 
-func (e *mobiExth) Add(recType uint32, Value interface{}) *mobiExth {
-	e.RecordCount++
-
+// Add adds a record. The value must suit the type of the record: an integer for numeric records,
+// a string or []byte for string records and a []byte for binary records.
+func (e *mobiExth) Add(recType uint32, Value interface{}) error {
 	var MetaType = getExthMetaByTag(recType)
 	var ExthRec = mobiExthRecord{RecordType: recType}
 
 	switch MetaType.Type {
 	case EXTH_TYPE_BINARY:
-		ExthRec.Value = Value.([]uint8)
+		value, ok := Value.([]uint8)
+		if !ok {
+			return errors.New("EXTH record " + strconv.Itoa(int(recType)) + " needs a []byte value")
+		}
+		ExthRec.Value = value
 	case EXTH_TYPE_NUMERIC:
 		var castValue uint32
 		switch Value.(type) {
 		case int:
 			castValue = uint32(Value.(int))
+		case uint:
+			castValue = uint32(Value.(uint))
+		case uint8:
+			castValue = uint32(Value.(uint8))
+		case int8:
+			castValue = uint32(Value.(int8))
 		case uint16:
 			castValue = uint32(Value.(uint16))
 		case uint32:
@@ -234,7 +248,7 @@ func (e *mobiExth) Add(recType uint32, Value interface{}) *mobiExth {
 		case int64:
 			castValue = uint32(Value.(int64))
 		default:
-			panic("EXTH_TYPE_NUMERIC type is unsupported")
+			return errors.New("EXTH record " + strconv.Itoa(int(recType)) + " needs an integer value")
 		}
 		ExthRec.Value = int32ToBytes(castValue)
 	case EXTH_TYPE_STRING:
@@ -243,12 +257,48 @@ func (e *mobiExth) Add(recType uint32, Value interface{}) *mobiExth {
 			ExthRec.Value = Value.([]uint8)
 		case string:
 			ExthRec.Value = []uint8(Value.(string))
+		default:
+			return errors.New("EXTH record " + strconv.Itoa(int(recType)) + " needs a string or []byte value")
 		}
 	default:
-		panic("Unknown EXTH meta type")
+		return errors.New("Unknown EXTH meta type")
 	}
 
 	ExthRec.RecordLength = uint32(8 + len(ExthRec.Value))
 	e.Records = append(e.Records, ExthRec)
-	return e
+	e.RecordCount++
+	return nil
+}
+
+// remove deletes all records of the given type
+func (e *mobiExth) remove(recType uint32) {
+	records := e.Records[:0]
+	for _, k := range e.Records {
+		if k.RecordType != recType {
+			records = append(records, k)
+		}
+	}
+	e.Records = records
+	e.RecordCount = uint32(len(records))
+}
+
+// Values returns the values of all records of the given type
+func (e *mobiExth) Values(recType uint32) [][]uint8 {
+	var out [][]uint8
+	for _, k := range e.Records {
+		if k.RecordType == recType {
+			out = append(out, k.Value)
+		}
+	}
+	return out
+}
+
+// Value returns the value of the first record of the given type
+func (e *mobiExth) Value(recType uint32) ([]uint8, bool) {
+	for _, k := range e.Records {
+		if k.RecordType == recType {
+			return k.Value, true
+		}
+	}
+	return nil, false
 }
@@ -20,14 +20,14 @@ type mobiFcis struct { //  RECORD -1
 	Fixed10    uint32 //UINT   fixed11 <comment="fixed value 0">;
 } //FCISRECORD;*/
 
-func (w *mobiBuilder) generateFcis() []byte {
+func (w *mobiBuilder) generateFcis(textLength uint32) []byte {
 	c := mobiFcis{}
 	c.Identifier = 1178814803 //StringToBytes("FLIS", &c.Identifier)
 	c.Fixed0 = 20
 	c.Fixed1 = 16
 	c.Fixed2 = 1
 	//c.Fixed3
-	c.Fixed4 = w.Pdh.TextLength
+	c.Fixed4 = textLength
 	//c.Fixed5 = 0
 	c.Fixed6 = 32
 	c.Fixed7 = 8
@@ -88,3 +88,17 @@ type mobiHeader struct {
 		    unknown20 uint32 ?
 	*/
 }
+
+// mobiHeaderKF8 follows mobiHeader in headers which are at least 248 bytes long. KF8 uses it to locate its indexes.
+// Record numbers are relative to KF8 record 0.
+type mobiHeaderKF8 struct {
+	FragmentIndex uint32 // Record number of the fragment index. 0xFFFFFFFF if index is not available.
+	SkeletonIndex uint32 // Record number of the skeleton index. 0xFFFFFFFF if index is not available.
+	DatpIndex     uint32
+	GuideIndex    uint32 // Record number of the guide index. 0xFFFFFFFF if index is not available.
+}
+
+// fdstRecordIndex returns the record number of the FDST record. KF8 stores it in place of FirstContentRecordNumber and LastContentRecordNumber.
+func (h *mobiHeader) fdstRecordIndex() uint32 {
+	return uint32(h.FirstContentRecordNumber)<<16 | uint32(h.LastContentRecordNumber)
+}
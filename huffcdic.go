@@ -0,0 +1,184 @@
+package mobi
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	huffHeaderLen = 24
+	cdicHeaderLen = 16
+
+	// huffMaxDepth limits the recursive expansion of dictionary entries
+	huffMaxDepth = 32
+)
+
+// huffCode is an entry of the HUFF cache table, indexed by the first 8 bits of a code
+type huffCode struct {
+	CodeLen uint32 // Length of the code, if Term is set
+	Term    bool   // Code length is fully determined by the first 8 bits
+	MaxCode uint64 // Left aligned maximum code for CodeLen
+}
+
+// cdicEntry is a dictionary phrase. Phrases which are not Literal are HUFF/CDIC compressed themselves.
+type cdicEntry struct {
+	Data    []byte
+	Literal bool
+}
+
+// huffcdicReader decompresses text records using the HUFF and CDIC records of a book
+type huffcdicReader struct {
+	cache      [256]huffCode
+	minCode    [33]uint64
+	maxCode    [33]uint64
+	dictionary []cdicEntry
+}
+
+// newHuffcdicReader parses the HUFF record followed by all of the CDIC records
+func newHuffcdicReader(huff []byte, cdics [][]byte) (*huffcdicReader, error) {
+	h := &huffcdicReader{}
+	if err := h.loadHuff(huff); err != nil {
+		return nil, err
+	}
+	for _, cdic := range cdics {
+		if err := h.loadCdic(cdic); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *huffcdicReader) loadHuff(huff []byte) error {
+	if len(huff) < huffHeaderLen || Peeker(huff[:4]).magic() != magicHuff {
+		return errors.New("HUFF record not found")
+	}
+
+	cacheOffset := binary.BigEndian.Uint32(huff[8:])
+	baseOffset := binary.BigEndian.Uint32(huff[12:])
+	if int(cacheOffset)+256*4 > len(huff) || int(baseOffset)+64*4 > len(huff) {
+		return errors.New("HUFF record too short")
+	}
+
+	for i := range h.cache {
+		v := binary.BigEndian.Uint32(huff[int(cacheOffset)+i*4:])
+		code := huffCode{CodeLen: v & 0x1F, Term: v&0x80 != 0}
+		if code.CodeLen == 0 {
+			return errors.New("HUFF record contains zero length code")
+		}
+		if code.CodeLen <= 8 && !code.Term {
+			return errors.New("HUFF record contains invalid code")
+		}
+		code.MaxCode = ((uint64(v>>8) + 1) << (32 - code.CodeLen)) - 1
+		h.cache[i] = code
+	}
+
+	for codeLen := uint32(1); codeLen <= 32; codeLen++ {
+		pos := int(baseOffset) + int(codeLen-1)*8
+		h.minCode[codeLen] = uint64(binary.BigEndian.Uint32(huff[pos:])) << (32 - codeLen)
+		h.maxCode[codeLen] = ((uint64(binary.BigEndian.Uint32(huff[pos+4:])) + 1) << (32 - codeLen)) - 1
+	}
+
+	return nil
+}
+
+func (h *huffcdicReader) loadCdic(cdic []byte) error {
+	if len(cdic) < cdicHeaderLen || Peeker(cdic[:4]).magic() != magicCdic {
+		return errors.New("CDIC record not found")
+	}
+
+	phrases := int(binary.BigEndian.Uint32(cdic[8:]))
+	bits := binary.BigEndian.Uint32(cdic[12:])
+	if bits > 16 {
+		return errors.New("CDIC record has invalid code length")
+	}
+
+	n := phrases - len(h.dictionary)
+	if n > 1<<bits {
+		n = 1 << bits
+	}
+
+	data := cdic[cdicHeaderLen:]
+	if n*2 > len(data) {
+		return errors.New("CDIC record too short")
+	}
+	for i := 0; i < n; i++ {
+		off := int(binary.BigEndian.Uint16(data[i*2:]))
+		if off+2 > len(data) {
+			return errors.New("CDIC offset out of range")
+		}
+		blen := binary.BigEndian.Uint16(data[off:])
+		end := off + 2 + int(blen&0x7FFF)
+		if end > len(data) {
+			return errors.New("CDIC entry out of range")
+		}
+		h.dictionary = append(h.dictionary, cdicEntry{Data: data[off+2 : end], Literal: blen&0x8000 != 0})
+	}
+
+	return nil
+}
+
+// Decompress expands a HUFF/CDIC compressed record. Trailing entries must be stripped beforehand.
+func (h *huffcdicReader) Decompress(data []byte) ([]byte, error) {
+	return h.unpack(data, 0)
+}
+
+func (h *huffcdicReader) unpack(data []byte, depth int) ([]byte, error) {
+	if depth > huffMaxDepth {
+		return nil, errors.New("HUFF/CDIC dictionary recursion is too deep")
+	}
+
+	out := make([]byte, 0, maxRecordSize)
+
+	bitsLeft := len(data) * 8
+	// Pad the input, so 8 bytes can always be read
+	padded := make([]byte, len(data)+8)
+	copy(padded, data)
+
+	pos := 0
+	x := binary.BigEndian.Uint64(padded)
+	n := 32
+	for {
+		if n <= 0 {
+			pos += 4
+			if pos+8 > len(padded) {
+				break
+			}
+			x = binary.BigEndian.Uint64(padded[pos:])
+			n += 32
+		}
+		code := (x >> uint(n)) & 0xFFFFFFFF
+
+		c := h.cache[code>>24]
+		codeLen, maxCode := c.CodeLen, c.MaxCode
+		if !c.Term {
+			for codeLen < 32 && code < h.minCode[codeLen] {
+				codeLen++
+			}
+			maxCode = h.maxCode[codeLen]
+		}
+
+		n -= int(codeLen)
+		bitsLeft -= int(codeLen)
+		if bitsLeft < 0 {
+			break
+		}
+
+		idx := (maxCode - code) >> (32 - codeLen)
+		if idx >= uint64(len(h.dictionary)) {
+			return nil, errors.New("HUFF code refers to a missing CDIC entry")
+		}
+
+		entry := &h.dictionary[idx]
+		if !entry.Literal {
+			expanded, err := h.unpack(entry.Data, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			// Cache the expansion, entries are likely to be used more than once
+			entry.Data, entry.Literal = expanded, true
+		}
+		out = append(out, entry.Data...)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,73 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// Hand assembled HUFF/CDIC records with two 1-bit codes. Code 1 is the literal "ab",
+// code 0 is a compressed phrase which expands to code 1 eight times.
+func testHuffcdicRecords() ([]byte, []byte) {
+	huff := new(bytes.Buffer)
+	huff.WriteString("HUFF")
+	binary.Write(huff, binary.BigEndian, []uint32{huffHeaderLen, huffHeaderLen, huffHeaderLen + 256*4, 0, 0})
+	for i := 0; i < 256; i++ {
+		binary.Write(huff, binary.BigEndian, uint32(1<<8|0x80|1))
+	}
+	binary.Write(huff, binary.BigEndian, []uint32{0, 1})
+	huff.Write(make([]byte, 31*8))
+
+	cdic := new(bytes.Buffer)
+	cdic.WriteString("CDIC")
+	binary.Write(cdic, binary.BigEndian, []uint32{cdicHeaderLen, 2, 1})
+	binary.Write(cdic, binary.BigEndian, []uint16{4, 8})
+	binary.Write(cdic, binary.BigEndian, uint16(0x8002))
+	cdic.WriteString("ab")
+	binary.Write(cdic, binary.BigEndian, uint16(1))
+	cdic.WriteByte(0xFF)
+
+	return huff.Bytes(), cdic.Bytes()
+}
+
+func TestHuffcdicDecompress(t *testing.T) {
+	huff, cdic := testHuffcdicRecords()
+	h, err := newHuffcdicReader(huff, [][]byte{cdic})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1000 0001: literal, six expanded phrases, literal
+	out, err := h.Decompress([]byte{0x81})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.Repeat("ab", 50); string(out) != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestHuffcdicRoundTrip(t *testing.T) {
+	chunks := [][]byte{[]byte(lipsum), []byte(strings.Repeat("<p>æøå</p>", 100)), {0, 1, 2, 0xFF}}
+	enc := newHuffcdicEncoder(chunks)
+
+	dec, err := newHuffcdicReader(enc.huffRecord(), enc.cdicRecords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, chunk := range chunks {
+		compressed := enc.Compress(chunk)
+		out, err := dec.Decompress(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, chunk) {
+			t.Errorf("Chunk %d differs after decompression", i)
+		}
+		if i == 0 && len(compressed) >= len(chunk)/2 {
+			t.Errorf("Poor compression ratio: %d of %d bytes", len(compressed), len(chunk))
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package mobi
 
+import "errors"
+
 const (
 	// IndxTypeNormal indicates normal index type
 	IndxTypeNormal uint32 = 0
@@ -36,3 +38,60 @@ type mobiIndxEntry struct {
 	EntryID    tagEntry
 	EntryValue uint32
 }
+
+// mobiIndexEntry is a single decoded entry of an index
+type mobiIndexEntry struct {
+	Label string
+	Tags  []mobiIndxEntry
+}
+
+// Values returns all values of the given tag, in the order they are stored
+func (e *mobiIndexEntry) Values(tag tagEntry) []uint32 {
+	var out []uint32
+	for _, t := range e.Tags {
+		if t.EntryID == tag {
+			out = append(out, t.EntryValue)
+		}
+	}
+	return out
+}
+
+// Value returns the first value of the given tag
+func (e *mobiIndexEntry) Value(tag tagEntry) (uint32, bool) {
+	for _, t := range e.Tags {
+		if t.EntryID == tag {
+			return t.EntryValue, true
+		}
+	}
+	return 0, false
+}
+
+// mobiIndex is an index read from its meta record, data records and CNCX records
+type mobiIndex struct {
+	Indx []mobiIndx // Meta record header, followed by data record headers
+	Tagx mobiTagx
+	Idxt mobiIdxt // IDXT of the last data record
+	Cncx mobiCncx
+	Ordt *mobiOrdt // Set if labels are stored as ORDT offsets
+
+	Encoding uint32 // Text encoding of the book, for labels of indexes which do not set their own
+
+	Entries     []mobiIndexEntry
+	CncxRecords [][]byte
+}
+
+// cncxString returns the CNCX string at the given offset. The high 16 bits select the CNCX record.
+func (idx *mobiIndex) cncxString(offset uint32) ([]byte, error) {
+	rec := int(offset >> 16)
+	pos := int(offset & 0xFFFF)
+	if rec >= len(idx.CncxRecords) || pos >= len(idx.CncxRecords[rec]) {
+		return nil, errors.New("CNCX offset is out of bounds")
+	}
+
+	data := idx.CncxRecords[rec][pos:]
+	size, consumed := vwiDec(data, true)
+	if int(consumed)+int(size) > len(data) {
+		return nil, errors.New("CNCX string is out of bounds")
+	}
+	return data[consumed : consumed+size], nil
+}
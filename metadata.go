@@ -0,0 +1,114 @@
+package mobi
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// Metadata holds the descriptive metadata of a book
+type Metadata struct {
+	Title          string
+	Authors        []string
+	Publisher      string
+	Description    string
+	ISBN           string
+	ASIN           string
+	Subjects       []string
+	Language       string
+	PublishingDate time.Time // Zero if the book has no date, or it could not be parsed
+	DocType        string    // PDOC - Personal Doc; EBOK - ebook; EBSP - ebook sample
+	CoverOffset    int       // Offset of the cover image from the first image record, -1 if the book has no cover
+}
+
+// Layouts tried, in order, when parsing EXTH_PUBLISHINGDATE
+var publishingDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// Metadata returns the metadata of the book, read from the full name in record 0 and the EXTH records
+func (r *Reader) Metadata() (*Metadata, error) {
+	title, err := r.fullName()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metadata{
+		Title:       title,
+		Authors:     r.exthStrings(EXTH_AUTHOR),
+		Publisher:   r.exthString(EXTH_PUBLISHER),
+		Description: r.exthString(EXTH_DESCRIPTION),
+		ISBN:        r.exthString(EXTH_ISBN),
+		ASIN:        r.exthString(EXTH_ASIN),
+		Subjects:    r.exthStrings(EXTH_SUBJECT),
+		Language:    r.exthString(EXTH_LANGUAGE),
+		DocType:     r.exthString(EXTH_DOCTYPE),
+		CoverOffset: -1,
+	}
+
+	if m.ASIN == "" {
+		m.ASIN = r.exthString(EXTH_ASIN504)
+	}
+
+	if value, ok := r.mobi.Exth.Value(EXTH_COVEROFFSET); ok && len(value) == 4 {
+		if offset := binary.BigEndian.Uint32(value); offset != uint32Max {
+			m.CoverOffset = int(offset)
+		}
+	}
+
+	if date := r.exthString(EXTH_PUBLISHINGDATE); date != "" {
+		m.PublishingDate = parsePublishingDate(date)
+	}
+
+	return m, nil
+}
+
+// fullName reads the full name of the book from record 0
+func (r *Reader) fullName() (string, error) {
+	if r.mobi.Header.FullNameLength == 0 {
+		return "", nil
+	}
+
+	rec, err := r.readRecord(0)
+	if err != nil {
+		return "", err
+	}
+
+	start := int(r.mobi.Header.FullNameOffset)
+	end := start + int(r.mobi.Header.FullNameLength)
+	if start > len(rec) || end > len(rec) {
+		return "", nil
+	}
+	return r.decodeString(rec[start:end]), nil
+}
+
+// exthString returns the first EXTH record of the given type as a string
+func (r *Reader) exthString(recType uint32) string {
+	if value, ok := r.mobi.Exth.Value(recType); ok {
+		return strings.TrimRight(r.decodeString(value), "\x00")
+	}
+	return ""
+}
+
+// exthStrings returns all EXTH records of the given type as strings
+func (r *Reader) exthStrings(recType uint32) []string {
+	var out []string
+	for _, value := range r.mobi.Exth.Values(recType) {
+		out = append(out, strings.TrimRight(r.decodeString(value), "\x00"))
+	}
+	return out
+}
+
+func parsePublishingDate(date string) time.Time {
+	date = strings.TrimSpace(date)
+	for _, layout := range publishingDateLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -1,6 +1,7 @@
 package mobi
 
 import (
+	"errors"
 	"reflect"
 )
 
@@ -19,14 +20,19 @@ type Mobi struct {
 	Cncx  mobiCncx
 	Tagx  mobiTagx
 	PTagx []mobiPTagx
+	Ncx   *mobiIndex // Decoded NCX index, if the book has one
+
+	KF8 *mobiKF8 // KF8 part of the book, if it has one
 }
 
 const (
 	maxRecordSize    = 4096
+	maxRecordCount   = 0xFFFF // Record numbers and counts are 16 bit
 	palmDBHeaderLen  = 78
 	indxHeaderLen    = 192
 	palmDocHeaderLen = 16
 	mobiHeaderLen    = 232
+	mobiHeaderKF8Len = 248
 )
 
 type mobiRecordOffset struct {
@@ -60,11 +66,16 @@ func (m mobiMagicType) String() string {
 	return string(m)
 }
 
-func (m mobiMagicType) WriteTo(output interface{}) {
-	out := reflect.ValueOf(output).Elem()
+// WriteTo copies the magic into output, a pointer to a byte array of the same length
+func (m mobiMagicType) WriteTo(output interface{}) error {
+	out := reflect.ValueOf(output)
+	if out.Kind() != reflect.Ptr || out.Elem().Kind() != reflect.Array {
+		return errors.New("Magic can only be written to a byte array")
+	}
+	out = out.Elem()
 
 	if out.Type().Len() != len(m) {
-		panic("Magic lenght is larger than target size")
+		return errors.New("Magic " + string(m) + " does not match the target size")
 	}
 
 	for i := 0; i < out.Type().Len(); i++ {
@@ -73,6 +84,7 @@ func (m mobiMagicType) WriteTo(output interface{}) {
 		}
 		out.Index(i).Set(reflect.ValueOf(byte(m[i])))
 	}
+	return nil
 }
 
 const (
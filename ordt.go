@@ -0,0 +1,149 @@
+package mobi
+
+import (
+	"encoding/binary"
+	"errors"
+	"unicode/utf16"
+)
+
+// mobiOrdt holds the ORDT tables of an index. Index labels are stored as offsets into ORDT2,
+// which holds the actual UTF-16 code units. Offsets beyond the table are code units themselves.
+type mobiOrdt struct {
+	Type  uint32   // 1 - labels use one byte per offset, otherwise two bytes
+	Ordt1 []uint8  // Sort order table
+	Ordt2 []uint16 // Offset to code unit table
+}
+
+// Ligature markers, as stored in dictionary index labels: a marker is followed by the base letter
+var ligatures = map[[2]uint16]uint16{
+	{1, 'E'}: 0x0152, // Œ
+	{2, 'e'}: 0x0153, // œ
+	{3, 'E'}: 0x00C6, // Æ
+	{4, 'e'}: 0x00E6, // æ
+	{5, 's'}: 0x00DF, // ß
+}
+
+// parseOrdt reads the ORDT1 and ORDT2 tables of an index meta record
+func parseOrdt(rec []byte, indx mobiIndx) (*mobiOrdt, error) {
+	ordt := &mobiOrdt{Type: indx.OrdtType}
+	count := int(indx.OrdtEntriesCount)
+
+	if pos := int(indx.Ordt1Offset); pos > 0 {
+		if pos+4+count > len(rec) || Peeker(rec[pos:pos+4]).magic() != magicOrdt {
+			return nil, errors.New("ORDT1 table not found at given offset")
+		}
+		ordt.Ordt1 = rec[pos+4 : pos+4+count]
+	}
+
+	if pos := int(indx.Ordt2Offset); pos > 0 {
+		if pos+4+count*2 > len(rec) || Peeker(rec[pos:pos+4]).magic() != magicOrdt {
+			return nil, errors.New("ORDT2 table not found at given offset")
+		}
+		ordt.Ordt2 = make([]uint16, count)
+		for i := range ordt.Ordt2 {
+			ordt.Ordt2[i] = binary.BigEndian.Uint16(rec[pos+4+i*2:])
+		}
+	}
+
+	return ordt, nil
+}
+
+// parseLigt checks for the LIGT section of an index meta record. Ligatures are expanded
+// from the markers in the labels, so the table itself is not needed to decode them.
+func parseLigt(rec []byte, indx mobiIndx) error {
+	pos := int(indx.LigtOffset)
+	if pos == 0 {
+		return nil
+	}
+	if pos+4 > len(rec) || Peeker(rec[pos:pos+4]).magic() != magicLigt {
+		return errors.New("LIGT table not found at given offset")
+	}
+	return nil
+}
+
+// codeUnits splits a label into code units, looking them up in ORDT2
+func (o *mobiOrdt) codeUnits(label []byte) []uint16 {
+	var units []uint16
+	for i := 0; i < len(label); {
+		var offset uint16
+		if o.Type == 1 {
+			offset = uint16(label[i])
+			i++
+		} else {
+			if i+1 >= len(label) {
+				break
+			}
+			offset = binary.BigEndian.Uint16(label[i:])
+			i += 2
+		}
+
+		if int(offset) < len(o.Ordt2) {
+			units = append(units, o.Ordt2[offset])
+		} else {
+			units = append(units, offset)
+		}
+	}
+	return units
+}
+
+// utf16BEUnits splits big endian UTF-16 text into code units
+func utf16BEUnits(data []byte) []uint16 {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+	return units
+}
+
+// expandLigatures replaces ligature markers and the following letter with the ligature
+func expandLigatures(units []uint16) []uint16 {
+	out := units[:0:0]
+	for i := 0; i < len(units); i++ {
+		if units[i] > 0 && units[i] <= 5 && i+1 < len(units) {
+			if lig, ok := ligatures[[2]uint16{units[i], units[i+1]}]; ok {
+				out = append(out, lig)
+				i++
+				continue
+			}
+		}
+		out = append(out, units[i])
+	}
+	return out
+}
+
+// labelEncoding returns the encoding of the labels: the one of the index, or the one of the book if the index does not set it
+func (idx *mobiIndex) labelEncoding() uint32 {
+	switch enc := idx.Indx[0].IdxtEncoding; enc {
+	case EncCP1252, EncUTF8, EncUTF16:
+		return enc
+	}
+	return idx.Encoding
+}
+
+// decodeLabel converts a raw index label to a string, using ORDT, the label encoding and ligatures as the index requires
+func (idx *mobiIndex) decodeLabel(label []byte) string {
+	var text string
+	var units []uint16
+	switch enc := idx.labelEncoding(); {
+	case idx.Ordt != nil:
+		units = idx.Ordt.codeUnits(label)
+	case enc == EncUTF16:
+		units = utf16BEUnits(label)
+	case enc == EncCP1252:
+		text = decodeCP1252(label)
+	default:
+		text = string(label)
+	}
+
+	if units == nil {
+		if idx.Indx[0].LigtEntriesCount == 0 {
+			return text
+		}
+		units = utf16.Encode([]rune(text))
+	}
+
+	if idx.Indx[0].LigtEntriesCount > 0 {
+		units = expandLigatures(units)
+	}
+	return string(utf16.Decode(units))
+}
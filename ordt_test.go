@@ -0,0 +1,74 @@
+package mobi
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseOrdt(t *testing.T) {
+	// ORDT2 maps offsets 0..3 to 'W', 'ö', and the surrogate pair of U+1F600
+	table := []uint16{'W', 0x00F6, 0xD83D, 0xDE00}
+
+	rec := make([]byte, 8)
+	rec = append(rec, "ORDT"...)
+	rec = append(rec, 0, 1, 2, 3)
+	ordt2 := len(rec)
+	rec = append(rec, "ORDT"...)
+	for _, u := range table {
+		rec = binary.BigEndian.AppendUint16(rec, u)
+	}
+
+	indx := mobiIndx{OrdtType: 1, OrdtEntriesCount: 4, Ordt1Offset: 8, Ordt2Offset: uint32(ordt2)}
+	ordt, err := parseOrdt(rec, indx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx := &mobiIndex{Indx: []mobiIndx{indx}, Ordt: ordt}
+	if label := idx.decodeLabel([]byte{0, 1, 2, 3}); label != "Wö😀" {
+		t.Errorf("Expected %q, got %q", "Wö😀", label)
+	}
+
+	// Offsets past the table are code units themselves
+	if label := idx.decodeLabel([]byte{'x'}); label != "x" {
+		t.Errorf("Expected %q, got %q", "x", label)
+	}
+
+	indx.Ordt1Offset = 4
+	if _, err := parseOrdt(rec, indx); err == nil {
+		t.Error("Expected an error for a misplaced ORDT table")
+	}
+}
+
+func TestDecodeLabelUTF16(t *testing.T) {
+	idx := &mobiIndex{Indx: []mobiIndx{{IdxtEncoding: EncUTF16, LigtEntriesCount: 1}}}
+
+	label := []byte{0, 'C', 0, 2, 0, 'e', 0, 'u', 0, 'r'}
+	if out := idx.decodeLabel(label); out != "Cœur" {
+		t.Errorf("Expected %q, got %q", "Cœur", out)
+	}
+
+	// Markers without a matching letter are kept
+	label = []byte{0, 5, 0, 'x'}
+	if out := idx.decodeLabel(label); out != "\x05x" {
+		t.Errorf("Expected %q, got %q", "\x05x", out)
+	}
+}
+
+func TestDecodeLabelCP1252(t *testing.T) {
+	// Ligature markers in a CP1252 label, followed by é and œ as single bytes
+	idx := &mobiIndex{Indx: []mobiIndx{{IdxtEncoding: EncCP1252, LigtEntriesCount: 1}}}
+	if out := idx.decodeLabel([]byte{'C', 2, 'e', 'u', 'r', ' ', 0xE9, 0x9C}); out != "Cœur éœ" {
+		t.Errorf("Expected %q, got %q", "Cœur éœ", out)
+	}
+
+	// Indexes without an encoding use the encoding of the book
+	idx = &mobiIndex{Indx: []mobiIndx{{}}, Encoding: EncCP1252}
+	if out := idx.decodeLabel([]byte{'C', 'a', 'f', 0xE9}); out != "Café" {
+		t.Errorf("Expected %q, got %q", "Café", out)
+	}
+	idx.Encoding = EncUTF8
+	if out := idx.decodeLabel([]byte("Café")); out != "Café" {
+		t.Errorf("Expected %q, got %q", "Café", out)
+	}
+}
@@ -0,0 +1,40 @@
+package mobi
+
+import "context"
+
+// WorkerPool limits the number of records compressed at the same time. A pool can be shared by
+// builders which build books concurrently, to bound their total CPU use.
+type WorkerPool struct {
+	slots chan struct{}
+}
+
+// NewWorkerPool creates a pool which lets up to size records be compressed at the same time
+func NewWorkerPool(size int) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+	return &WorkerPool{slots: make(chan struct{}, size)}
+}
+
+// acquire waits for a free slot. A nil pool has no limit. It returns the error of ctx if ctx is done first.
+func (p *WorkerPool) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if p == nil {
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot taken by acquire
+func (p *WorkerPool) release() {
+	if p != nil {
+		<-p.slots
+	}
+}
@@ -0,0 +1,56 @@
+package mobi
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentBuildersWithSharedPool(t *testing.T) {
+	pool := NewWorkerPool(2)
+	text := []byte(strings.Repeat("<p>"+lipsum+"</p>", 20))
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m := NewBuilder()
+			m.Compression(CompressionPalmDoc)
+			m.CompressionStrategy(CompressionStrategy(i % 2))
+			m.Workers(3)
+			m.WorkerPool(pool)
+			m.NewChapter("Chapter 1", text)
+
+			out := new(bytes.Buffer)
+			if _, errs[i] = m.WriteTo(out); errs[i] != nil {
+				return
+			}
+			r, _ := NewReaderFrom(bytes.NewReader(out.Bytes()), int64(out.Len()))
+			if errs[i] = r.Parse(); errs[i] != nil {
+				return
+			}
+			raw, err := r.RawML()
+			if err == nil && !bytes.Contains(raw, text) {
+				err = errors.New("Text read back differs")
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Builder %d: %v", i, err)
+		}
+	}
+	if len(pool.slots) != 0 {
+		t.Errorf("%d pool slots were not released", len(pool.slots))
+	}
+	if err := NewBuilder().CompressionStrategy(CompressionStrategy(42)); err == nil {
+		t.Error("Unknown compression strategy was accepted")
+	}
+}
@@ -0,0 +1,37 @@
+package mobi
+
+// Stage is a stage of building a book, as reported to the callback set with OnProgress
+type Stage string
+
+const (
+	// StageHTML assembles the HTML of the chapters and resolves their links. It counts chapters.
+	StageHTML Stage = "html"
+	// StageCompression converts the text to text records. It counts records.
+	StageCompression Stage = "compression"
+	// StageIndex generates the NCX index. It counts the chapters listed.
+	StageIndex Stage = "index"
+	// StageResources adds the images, FLIS and FCIS records. It counts records.
+	StageResources Stage = "resources"
+)
+
+// Progress reports how far a stage of building a book is. A stage is reported with Done 0 when it starts,
+// and with Done equal to Total once it is complete. Books with a KF8 part go through the compression and
+// index stages again for the KF8 part.
+type Progress struct {
+	Stage Stage
+	Done  int
+	Total int
+}
+
+// OnProgress sets a callback which is called as the book is built. It is called from one goroutine at a time,
+// and should return quickly, as building waits for it.
+func (w *mobiBuilder) OnProgress(fn func(p Progress)) {
+	w.progress = fn
+}
+
+// report calls the progress callback, if any
+func (w *mobiBuilder) report(stage Stage, done, total int) {
+	if w.progress != nil {
+		w.progress(Progress{Stage: stage, Done: done, Total: total})
+	}
+}
@@ -0,0 +1,75 @@
+package mobi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteToContext(t *testing.T) {
+	newBook := func() Builder {
+		m := NewBuilder()
+		m.Title("Context Test")
+		m.Compression(CompressionPalmDoc)
+		m.Workers(2)
+		m.NewChapter("Chapter 1", []byte(strings.Repeat("<p>"+lipsum+"</p>", 4))).AddSubChapter("Chapter 1-1", []byte("<p>Text</p>"))
+		return m
+	}
+
+	var stages []Stage
+	last := map[Stage]Progress{}
+	m := newBook()
+	m.OnProgress(func(p Progress) {
+		if len(stages) == 0 || stages[len(stages)-1] != p.Stage {
+			stages = append(stages, p.Stage)
+		}
+		if prev, ok := last[p.Stage]; ok && p.Done < prev.Done {
+			t.Errorf("Progress of %s went back from %d to %d", p.Stage, prev.Done, p.Done)
+		}
+		last[p.Stage] = p
+	})
+	if _, err := m.WriteToContext(context.Background(), new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Stage{StageHTML, StageCompression, StageIndex, StageResources}
+	if fmt.Sprint(stages) != fmt.Sprint(expected) {
+		t.Errorf("Expected stages %v, got %v", expected, stages)
+	}
+	for stage, p := range last {
+		if p.Done != p.Total || p.Total == 0 {
+			t.Errorf("Stage %s ended at %d of %d", stage, p.Done, p.Total)
+		}
+	}
+	if last[StageHTML].Total != 3 || last[StageCompression].Total < 4 {
+		t.Errorf("Unexpected totals %v", last)
+	}
+
+	// Cancelled while compressing
+	ctx, cancel := context.WithCancel(context.Background())
+	m = newBook()
+	m.OnProgress(func(p Progress) {
+		if p.Stage == StageCompression && p.Done == 1 {
+			cancel()
+		}
+	})
+	out := new(bytes.Buffer)
+	if _, err := m.WriteToContext(ctx, out); !errors.Is(err, context.Canceled) || out.Len() > 0 {
+		t.Errorf("Cancelled build returned %v after writing %d bytes", err, out.Len())
+	}
+
+	// Cancelled while waiting for a busy pool
+	pool := NewWorkerPool(1)
+	pool.acquire(context.Background())
+	defer pool.release()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	m = newBook()
+	m.WorkerPool(pool)
+	if _, err := m.WriteToContext(ctx, new(bytes.Buffer)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Build waiting for the pool returned %v", err)
+	}
+}
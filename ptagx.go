@@ -20,6 +20,16 @@ const (
 	tagEntryImgAttrOffset               = 73 // Image attribution offset in cncx
 )
 
+// Tags of the KF8 skeleton and fragment indexes
+const (
+	tagSkelFragCount tagEntry = 1 // SKEL | Number of fragments inserted into the skeleton
+	tagSkelPos       tagEntry = 6 // SKEL | Start and length of the skeleton in the text
+	tagFragSelector  tagEntry = 2 // FRAG | CNCX offset of the selector of the element the fragment goes into
+	tagFragFileNum   tagEntry = 3 // FRAG | Number of the skeleton (file) the fragment belongs to
+	tagFragSeqNum    tagEntry = 4 // FRAG | Sequence number of the fragment
+	tagFragPos       tagEntry = 6 // FRAG | Start and length of the fragment
+)
+
 var tagEntryMap = map[tagEntry]string{
 	tagEntryPos:                "Offset",
 	tagEntryLen:                "Lenght",
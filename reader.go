@@ -3,11 +3,10 @@ package mobi
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"reflect"
-	"strconv"
 )
 
 // Reader allows for reading a Mobi file
@@ -15,6 +14,10 @@ type Reader struct {
 	file     io.ReadSeeker
 	fileSize int64
 	mobi     Mobi
+
+	huff map[uint32]*huffcdicReader // Loaded on demand for HUFF/CDIC compressed books, by record number of HUFF
+
+	logger *slog.Logger
 }
 
 // NewReader constructs a new reader
@@ -41,6 +44,19 @@ func NewReaderFrom(rs io.ReadSeeker, len int64) (out *Reader, err error) {
 	return &Reader{file: rs, fileSize: len}, nil
 }
 
+// SetLogger sets the logger the Reader writes the details of the parsed records to, at debug level.
+// Without a logger nothing is logged.
+func (r *Reader) SetLogger(l *slog.Logger) {
+	r.logger = l
+}
+
+func (r *Reader) log() *slog.Logger {
+	if r.logger == nil {
+		return discardLogger
+	}
+	return r.logger
+}
+
 // Parse will parse the fields of the file into this Reader
 func (r *Reader) Parse() (err error) {
 	if err = r.parsePdf(); err != nil {
@@ -52,14 +68,14 @@ func (r *Reader) Parse() (err error) {
 	}
 
 	// Check if INDX offset is set + attempt to parse INDX
-	if r.mobi.Header.IndxRecodOffset > 0 {
+	if r.mobi.Header.IndxRecodOffset > 0 && r.mobi.Header.IndxRecodOffset != uint32Max {
 		err = r.parseIndexRecord(r.mobi.Header.IndxRecodOffset)
 		if err != nil {
 			return
 		}
 	}
 
-	return
+	return r.parseKF8()
 }
 
 // parseHeader reads Palm Database Format header, and record offsets
@@ -123,132 +139,6 @@ func (r *Reader) parsePdh() error {
 	return nil
 }
 
-func (r *Reader) parseIndexRecord(n uint32) error {
-	_, err := r.OffsetToRecord(n)
-	if err != nil {
-		return err
-	}
-
-	RecPos, _ := r.file.Seek(0, io.SeekCurrent)
-
-	if !r.MatchMagic(magicIndx) {
-		return errors.New("Index record not found at specified at given offset")
-	}
-	//fmt.Printf("Index %s %v\n", r.Peek(4), RecLen)
-
-	//if len(r.Indx) == 0 {
-	r.mobi.Indx = append(r.mobi.Indx, mobiIndx{})
-	//}
-
-	idx := &r.mobi.Indx[len(r.mobi.Indx)-1]
-
-	err = binary.Read(r.file, binary.BigEndian, idx)
-	if err != nil {
-		return err
-	}
-
-	/* Tagx Record Parsing + Last CNCX */
-	if idx.TagxOffset != 0 {
-		_, err = r.file.Seek(RecPos+int64(idx.TagxOffset), io.SeekStart)
-		if err != nil {
-			return err
-		}
-
-		err = r.parseTagx()
-		if err != nil {
-			return err
-		}
-
-		// Last CNCX record follows TAGX
-		if idx.CncxRecordsCount > 0 {
-			r.mobi.Cncx = mobiCncx{}
-			binary.Read(r.file, binary.BigEndian, &r.mobi.Cncx.Len)
-
-			r.mobi.Cncx.ID = make([]uint8, r.mobi.Cncx.Len)
-			binary.Read(r.file, binary.LittleEndian, &r.mobi.Cncx.ID)
-			r.file.Seek(1, io.SeekCurrent) //Skip 0x0 termination
-
-			binary.Read(r.file, binary.BigEndian, &r.mobi.Cncx.NCXCount)
-
-			// PrintStruct(r.Cncx)
-		}
-	}
-
-	/* Ordt Record Parsing */
-	if idx.IdxtEncoding == EncUTF16 || idx.OrdtEntriesCount > 0 {
-		return errors.New("ORDT parser not implemented")
-	}
-
-	/* Ligt Record Parsing */
-	if idx.LigtEntriesCount > 0 {
-		return errors.New("LIGT parser not implemented")
-	}
-
-	/* Idxt Record Parsing */
-	if idx.IdxtCount > 0 {
-		_, err = r.file.Seek(RecPos+int64(idx.IdxtOffset), io.SeekStart)
-		if err != nil {
-			return err
-		}
-
-		err = r.parseIdxt(idx.IdxtCount)
-		if err != nil {
-			return err
-		}
-	}
-
-	//CNCX Data?
-	var Count = 0
-	if idx.IndxType == IndxTypeNormal {
-		//r.file.Seek(RecPos+int64(idx.HeaderLen), 0)
-
-		var PTagxLen = []uint8{0}
-		for i, offset := range r.mobi.Idxt.Offset {
-			r.file.Seek(RecPos+int64(offset), io.SeekStart)
-
-			// Read Byte containing the lenght of a label
-			r.file.Read(PTagxLen)
-
-			// Read label
-			PTagxLabel := make([]uint8, PTagxLen[0])
-			r.file.Read(PTagxLabel)
-
-			PTagxLen1 := uint16(idx.IdxtOffset) - r.mobi.Idxt.Offset[i]
-			if i+1 < len(r.mobi.Idxt.Offset) {
-				PTagxLen1 = r.mobi.Idxt.Offset[i+1] - r.mobi.Idxt.Offset[i]
-			}
-
-			PTagxData := make([]uint8, PTagxLen1)
-			r.file.Read(PTagxData)
-			if isNotSkipLog {
-				fmt.Printf("\n------ %v --------\n", i)
-			}
-			r.parsePtagx(PTagxData)
-			Count++
-			//fmt.Printf("Len: %v | Label: %s | %v\n", PTagxLen, PTagxLabel, Count)
-		}
-	}
-
-	// Check next record
-	//r.OffsetToRecord(n + 1)
-
-	//
-	// Process remaining INDX records
-	if idx.IndxType == IndxTypeInflection {
-		r.parseIndexRecord(n + 1)
-	}
-	//fmt.Printf("%s", )
-	// Read Tagx
-	//		if idx.Tagx_Offset > 0 {
-	//			err := r.parseTagx()
-	//			if err != nil {
-	//				return err
-	//			}
-	//		}
-
-	return nil
-}
-
 // MatchMagic matches next N bytes (based on lenght of magic word)
 func (r *Reader) MatchMagic(magic mobiMagicType) bool {
 	if r.Peek(len(magic)).magic() == magic {
@@ -272,27 +162,35 @@ func (r *Reader) ExthParse() error {
 		return errors.New("Currect reading position does not contain EXTH record")
 	}
 
-	binary.Read(r.file, binary.BigEndian, &r.mobi.Exth.Identifier)
-	binary.Read(r.file, binary.BigEndian, &r.mobi.Exth.HeaderLenght)
-	binary.Read(r.file, binary.BigEndian, &r.mobi.Exth.RecordCount)
+	return readExth(r.file, &r.mobi.Exth)
+}
 
-	r.mobi.Exth.Records = make([]mobiExthRecord, r.mobi.Exth.RecordCount)
-	for i := range r.mobi.Exth.Records {
-		binary.Read(r.file, binary.BigEndian, &r.mobi.Exth.Records[i].RecordType)
-		binary.Read(r.file, binary.BigEndian, &r.mobi.Exth.Records[i].RecordLength)
+// readExth reads the EXTH header and its records
+func readExth(rd io.Reader, exth *mobiExth) error {
+	binary.Read(rd, binary.BigEndian, &exth.Identifier)
+	binary.Read(rd, binary.BigEndian, &exth.HeaderLenght)
+	binary.Read(rd, binary.BigEndian, &exth.RecordCount)
+
+	exth.Records = make([]mobiExthRecord, exth.RecordCount)
+	for i := range exth.Records {
+		binary.Read(rd, binary.BigEndian, &exth.Records[i].RecordType)
+		binary.Read(rd, binary.BigEndian, &exth.Records[i].RecordLength)
+		if exth.Records[i].RecordLength < 8 {
+			return errors.New("EXTH record is shorter than its header")
+		}
 
-		r.mobi.Exth.Records[i].Value = make([]uint8, r.mobi.Exth.Records[i].RecordLength-8)
+		exth.Records[i].Value = make([]uint8, exth.Records[i].RecordLength-8)
 
-		Tag := getExthMetaByTag(r.mobi.Exth.Records[i].RecordType)
+		Tag := getExthMetaByTag(exth.Records[i].RecordType)
 		switch Tag.Type {
 		case EXTH_TYPE_BINARY:
-			binary.Read(r.file, binary.BigEndian, &r.mobi.Exth.Records[i].Value)
+			binary.Read(rd, binary.BigEndian, &exth.Records[i].Value)
 			//			fmt.Printf("%v: %v\n", Tag.Name, r.Exth.Records[i].Value)
 		case EXTH_TYPE_STRING:
-			binary.Read(r.file, binary.LittleEndian, &r.mobi.Exth.Records[i].Value)
+			binary.Read(rd, binary.LittleEndian, &exth.Records[i].Value)
 			//			fmt.Printf("%v: %s\n", Tag.Name, r.Exth.Records[i].Value)
 		case EXTH_TYPE_NUMERIC:
-			binary.Read(r.file, binary.BigEndian, &r.mobi.Exth.Records[i].Value)
+			binary.Read(rd, binary.BigEndian, &exth.Records[i].Value)
 			//			fmt.Printf("%v: %d\n", Tag.Name, binary.BigEndian.Uint32(r.Exth.Records[i].Value))
 		}
 	}
@@ -303,176 +201,22 @@ func (r *Reader) ExthParse() error {
 // OffsetToRecord sets reading position to record N, returns total record lenght
 func (r *Reader) OffsetToRecord(nu uint32) (uint32, error) {
 	n := int(nu)
-	if n > int(r.mobi.Pdf.RecordsNum)-1 {
+	if n > int(r.mobi.Pdf.RecordsNum)-1 || n >= len(r.mobi.Offsets) {
 		return 0, errors.New("Record ID requested is greater than total amount of records")
 	}
 
-	RecLen := uint32(0)
-	if n+1 < int(r.mobi.Pdf.RecordsNum) {
-		RecLen = r.mobi.Offsets[n+1].Offset
-	} else {
-		RecLen = uint32(r.fileSize)
+	start, end := int64(r.mobi.Offsets[n].Offset), r.fileSize
+	if n+1 < len(r.mobi.Offsets) && int64(r.mobi.Offsets[n+1].Offset) < end {
+		end = int64(r.mobi.Offsets[n+1].Offset)
 	}
-
-	_, err := r.file.Seek(int64(r.mobi.Offsets[n].Offset), io.SeekStart)
-
-	return RecLen - r.mobi.Offsets[n].Offset, err
-}
-
-func (r *Reader) parseTagx() error {
-	if !r.MatchMagic(magicTagx) {
-		return errors.New("TAGX record not found at given offset")
+	if start > r.fileSize {
+		return 0, errors.New("Record starts past the end of the file")
 	}
-
-	r.mobi.Tagx = mobiTagx{}
-
-	binary.Read(r.file, binary.BigEndian, &r.mobi.Tagx.Identifier)
-	binary.Read(r.file, binary.BigEndian, &r.mobi.Tagx.HeaderLenght)
-	if r.mobi.Tagx.HeaderLenght < 12 {
-		return errors.New("TAGX record too short")
+	if end < start {
+		return 0, errors.New("Record ends before it starts")
 	}
-	binary.Read(r.file, binary.BigEndian, &r.mobi.Tagx.ControlByteCount)
 
-	TagCount := (r.mobi.Tagx.HeaderLenght - 12) / 4
-	r.mobi.Tagx.Tags = make([]mobiTagxTags, TagCount)
+	_, err := r.file.Seek(start, io.SeekStart)
 
-	for i := 0; i < int(TagCount); i++ {
-		err := binary.Read(r.file, binary.BigEndian, &r.mobi.Tagx.Tags[i])
-		if err != nil {
-			return err
-		}
-	}
-	if isNotSkipLog {
-		fmt.Println("TagX called")
-	}
-	// PrintStruct(r.Tagx)
-
-	return nil
-}
-
-func (r *Reader) parseIdxt(IdxtCount uint32) error {
-	if isNotSkipLog {
-		fmt.Println("parseIdxt called")
-	}
-	if !r.MatchMagic(magicIdxt) {
-		return errors.New("IDXT record not found at given offset")
-	}
-
-	binary.Read(r.file, binary.BigEndian, &r.mobi.Idxt.Identifier)
-
-	r.mobi.Idxt.Offset = make([]uint16, IdxtCount)
-
-	binary.Read(r.file, binary.BigEndian, &r.mobi.Idxt.Offset)
-	//for id, _ := range r.Idxt.Offset {
-	//	binary.Read(r.Buffer, binary.BigEndian, &r.Idxt.Offset[id])
-	//}
-
-	//Skip two bytes? Or skip necessary amount to reach total lenght in multiples of 4?
-	r.file.Seek(2, io.SeekCurrent)
-
-	// PrintStruct(r.Idxt)
-	return nil
-}
-
-func (r *Reader) parsePtagx(data []byte) {
-	//control_byte_count
-	//tagx
-	controlBytes := data[:r.mobi.Tagx.ControlByteCount]
-	data = data[r.mobi.Tagx.ControlByteCount:]
-
-	var Ptagx []mobiPTagx //= make([]mobiPTagx, r.Tagx.TagCount())
-
-	for _, x := range r.mobi.Tagx.Tags {
-		if x.ControlByte == 0x01 {
-			controlBytes = controlBytes[1:]
-			continue
-		}
-
-		value := controlBytes[0] & x.Bitmask
-		if value != 0 {
-			var valCount uint32
-			var valBytes uint32
-
-			if value == x.Bitmask {
-				if setBits[x.Bitmask] > 1 {
-					// If all bits of masked value are set and the mask has more
-					// than one bit, a variable width value will follow after
-					// the control bytes which defines the length of bytes (NOT
-					// the value count!) which will contain the corresponding
-					// variable width values.
-					var consumed uint32
-					valBytes, consumed = vwiDec(data, true)
-					//fmt.Printf("\nConsumed %v", consumed)
-					data = data[consumed:]
-				} else {
-					valCount = 1
-				}
-			} else {
-				mask := x.Bitmask
-				for {
-					if mask&1 != 0 {
-						//fmt.Printf("Break")
-						break
-					}
-					mask >>= 1
-					value >>= 1
-				}
-				valCount = uint32(value)
-			}
-
-			Ptagx = append(Ptagx, mobiPTagx{x.Tag, x.TagNum, valCount, valBytes})
-			//						ptagx[ptagx_count].tag = tagx->tags[i].tag;
-			//       ptagx[ptagx_count].tag_value_count = tagx->tags[i].values_count;
-			//       ptagx[ptagx_count].value_count = value_count;
-			//       ptagx[ptagx_count].value_bytes = value_bytes;
-
-			//fmt.Printf("TAGX %v %v VC:%v VB:%v\n", x.Tag, x.TagNum, value_count, value_bytes)
-		}
-	}
-	if isNotSkipLog {
-		fmt.Printf("%+v", Ptagx)
-	}
-	var IndxEntry []mobiIndxEntry
-	for iz, x := range Ptagx {
-		var values []uint32
-
-		if x.ValueCount != 0 {
-			// Read value_count * values_per_entry variable width values.
-			if isNotSkipLog {
-				fmt.Printf("\nDec: ")
-			}
-			for i := 0; i < int(x.ValueCount)*int(x.TagValueCount); i++ {
-				byts, consumed := vwiDec(data, true)
-				data = data[consumed:]
-
-				values = append(values, byts)
-				IndxEntry = append(IndxEntry, mobiIndxEntry{x.Tag, byts})
-				if isNotSkipLog {
-					fmt.Printf("%v %s: %v ", iz, tagEntryMap[x.Tag], byts)
-				}
-			}
-		} else {
-			// Convert value_bytes to variable width values.
-			totalConsumed := 0
-			for {
-				if totalConsumed < int(x.ValueBytes) {
-					byts, consumed := vwiDec(data, true)
-					data = data[consumed:]
-
-					totalConsumed += int(consumed)
-
-					values = append(values, byts)
-					IndxEntry = append(IndxEntry, mobiIndxEntry{x.Tag, byts})
-				} else {
-					break
-				}
-			}
-			if totalConsumed != int(x.ValueBytes) {
-				panic("Error not enough bytes are consumed. Consumed " + strconv.Itoa(totalConsumed) + " out of " + strconv.Itoa(int(x.ValueBytes)))
-			}
-		}
-	}
-	if isNotSkipLog {
-		fmt.Println("---------------------------")
-	}
+	return uint32(end - start), err
 }
@@ -0,0 +1,115 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// ImageFormat is the format of an embedded image, detected from its content
+type ImageFormat int
+
+const (
+	// ImageUnknown is not a recognised image format
+	ImageUnknown ImageFormat = iota
+	// ImageJPEG is a JPEG image
+	ImageJPEG
+	// ImageGIF is a GIF image
+	ImageGIF
+	// ImagePNG is a PNG image
+	ImagePNG
+	// ImageBMP is a BMP image
+	ImageBMP
+)
+
+func (f ImageFormat) String() string {
+	switch f {
+	case ImageJPEG:
+		return "jpeg"
+	case ImageGIF:
+		return "gif"
+	case ImagePNG:
+		return "png"
+	case ImageBMP:
+		return "bmp"
+	}
+	return "unknown"
+}
+
+// Image is an image record embedded in the book
+type Image struct {
+	Record uint32 // Record number in the file
+	Offset uint32 // Offset from the first image record, as used by recindex and EXTH_COVEROFFSET
+	Format ImageFormat
+	Data   []byte
+}
+
+// sniffImageFormat detects the format of an image from its signature
+func sniffImageFormat(data []byte) ImageFormat {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return ImageJPEG
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return ImageGIF
+	case bytes.HasPrefix(data, []byte{0x89, 'P', 'N', 'G', 0x0D, 0x0A, 0x1A, 0x0A}):
+		return ImagePNG
+	case bytes.HasPrefix(data, []byte("BM")) && len(data) > 14:
+		return ImageBMP
+	}
+	return ImageUnknown
+}
+
+// Images returns the image records of the book, starting from FirstImageIndex up to the first record which is not an image
+func (r *Reader) Images() ([]Image, error) {
+	first := r.mobi.Header.FirstImageIndex
+	if first == 0 || first == uint32Max {
+		return nil, nil
+	}
+
+	var images []Image
+	for n := first; n < uint32(r.mobi.Pdf.RecordsNum); n++ {
+		img, err := r.readImage(n - first)
+		if err != nil {
+			return nil, err
+		}
+		if img.Format == ImageUnknown {
+			break
+		}
+		images = append(images, *img)
+	}
+	return images, nil
+}
+
+// Cover returns the cover image referenced by EXTH_COVEROFFSET. It returns nil if the book has no cover.
+func (r *Reader) Cover() (*Image, error) {
+	return r.exthImage(EXTH_COVEROFFSET)
+}
+
+// Thumbnail returns the thumbnail image referenced by EXTH_THUMBOFFSET. It returns nil if the book has no thumbnail.
+func (r *Reader) Thumbnail() (*Image, error) {
+	return r.exthImage(EXTH_THUMBOFFSET)
+}
+
+// exthImage reads the image at the offset stored in a numeric EXTH record
+func (r *Reader) exthImage(recType uint32) (*Image, error) {
+	value, ok := r.mobi.Exth.Value(recType)
+	if !ok || len(value) != 4 {
+		return nil, nil
+	}
+
+	offset := binary.BigEndian.Uint32(value)
+	first := r.mobi.Header.FirstImageIndex
+	if offset == uint32Max || first == 0 || first == uint32Max {
+		return nil, nil
+	}
+	return r.readImage(offset)
+}
+
+// readImage reads the image at the given offset from the first image record
+func (r *Reader) readImage(offset uint32) (*Image, error) {
+	n := r.mobi.Header.FirstImageIndex + offset
+	data, err := r.readRecord(n)
+	if err != nil {
+		return nil, err
+	}
+	return &Image{Record: n, Offset: offset, Format: sniffImageFormat(data), Data: data}, nil
+}
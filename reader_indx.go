@@ -0,0 +1,295 @@
+package mobi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"strconv"
+)
+
+// parseIndexRecord reads the NCX index starting at record N
+func (r *Reader) parseIndexRecord(n uint32) error {
+	idx, err := r.readIndex(n)
+	if err != nil {
+		return err
+	}
+
+	r.mobi.Indx = idx.Indx
+	r.mobi.Tagx = idx.Tagx
+	r.mobi.Idxt = idx.Idxt
+	r.mobi.Cncx = idx.Cncx
+	r.mobi.Ncx = idx
+	return nil
+}
+
+// readIndex reads an index: the meta INDX record N, followed by its data INDX records and its CNCX records
+func (r *Reader) readIndex(n uint32) (*mobiIndex, error) {
+	rec, err := r.readRecord(n)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &mobiIndex{Encoding: r.mobi.Header.TextEncoding}
+	meta, err := parseIndx(rec)
+	if err != nil {
+		return nil, err
+	}
+	out.Indx = append(out.Indx, meta)
+
+	/* Tagx Record Parsing + Last CNCX */
+	if meta.TagxOffset == 0 {
+		return nil, errors.New("TAGX record not found in index")
+	}
+	out.Tagx, err = parseTagx(rec[meta.TagxOffset:])
+	if err != nil {
+		return nil, err
+	}
+	r.log().Debug("Index meta record", "record", n, "type", meta.IndxType, "data_records", meta.IdxtCount,
+		"entries", meta.IdxtEntryCount, "cncx_records", meta.CncxRecordsCount, "tags", len(out.Tagx.Tags))
+
+	// The label of the last entry and the entry count of the (first) data record follow TAGX
+	pos := int(meta.TagxOffset + out.Tagx.HeaderLenght)
+	if pos < len(rec) {
+		out.Cncx.Len = rec[pos]
+		if end := pos + 1 + int(out.Cncx.Len); end+2 <= len(rec) {
+			out.Cncx.ID = rec[pos+1 : end]
+			out.Cncx.NCXCount = binary.BigEndian.Uint16(rec[end:])
+		}
+	}
+
+	/* Ordt Record Parsing */
+	if meta.OrdtEntriesCount > 0 {
+		out.Ordt, err = parseOrdt(rec, meta)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	/* Ligt Record Parsing */
+	if meta.LigtEntriesCount > 0 {
+		if err = parseLigt(rec, meta); err != nil {
+			return nil, err
+		}
+	}
+
+	// Data records follow the meta record. IdxtCount of the meta record is the number of data records.
+	for i := uint32(1); i <= meta.IdxtCount; i++ {
+		if err = r.readIndexData(n+i, out); err != nil {
+			return nil, err
+		}
+	}
+
+	// CNCX records follow the data records
+	for i := uint32(0); i < meta.CncxRecordsCount; i++ {
+		cncx, err := r.readRecord(n + meta.IdxtCount + 1 + i)
+		if err != nil {
+			return nil, err
+		}
+		out.CncxRecords = append(out.CncxRecords, cncx)
+	}
+
+	return out, nil
+}
+
+// readIndexData reads the entries of index data record N
+func (r *Reader) readIndexData(n uint32, idx *mobiIndex) error {
+	rec, err := r.readRecord(n)
+	if err != nil {
+		return err
+	}
+
+	indx, err := parseIndx(rec)
+	if err != nil {
+		return err
+	}
+	idx.Indx = append(idx.Indx, indx)
+
+	if int(indx.IdxtOffset) > len(rec) {
+		return errors.New("IDXT offset is out of record bounds")
+	}
+	idx.Idxt, err = parseIdxt(rec[indx.IdxtOffset:], indx.IdxtCount)
+	if err != nil {
+		return err
+	}
+	r.log().Debug("Index data record", "record", n, "entries", indx.IdxtCount)
+
+	for i, offset := range idx.Idxt.Offset {
+		end := int(indx.IdxtOffset)
+		if i+1 < len(idx.Idxt.Offset) {
+			end = int(idx.Idxt.Offset[i+1])
+		}
+		if int(offset) >= end || end > len(rec) {
+			return errors.New("IDXT entry offset is out of record bounds")
+		}
+		data := rec[offset:end]
+
+		// First byte contains the lenght of a label
+		labelEnd := 1 + int(data[0])
+		if labelEnd > len(data) {
+			return errors.New("Index entry label is out of record bounds")
+		}
+
+		entry := mobiIndexEntry{Label: idx.decodeLabel(data[1:labelEnd])}
+		entry.Tags, err = parsePtagx(idx.Tagx, data[labelEnd:])
+		if err != nil {
+			return err
+		}
+		if log := r.log(); log.Enabled(context.Background(), slog.LevelDebug) {
+			log.Debug("Index entry", "record", n, "entry", i, "label", entry.Label, slog.Group("tags", entryTagAttrs(entry.Tags)...))
+		}
+		idx.Entries = append(idx.Entries, entry)
+	}
+
+	return nil
+}
+
+// entryTagAttrs groups the tag values of an index entry into log attributes, keyed by tag number
+func entryTagAttrs(tags []mobiIndxEntry) []any {
+	var order []tagEntry
+	values := make(map[tagEntry][]uint32)
+	for _, t := range tags {
+		if _, ok := values[t.EntryID]; !ok {
+			order = append(order, t.EntryID)
+		}
+		values[t.EntryID] = append(values[t.EntryID], t.EntryValue)
+	}
+
+	attrs := make([]any, len(order))
+	for i, tag := range order {
+		attrs[i] = slog.Any(strconv.Itoa(int(tag)), values[tag])
+	}
+	return attrs
+}
+
+// parseIndx reads the INDX header at the start of a record
+func parseIndx(rec []byte) (indx mobiIndx, err error) {
+	if len(rec) < 4 || Peeker(rec[:4]).magic() != magicIndx {
+		return indx, errors.New("Index record not found at specified at given offset")
+	}
+	err = binary.Read(bytes.NewReader(rec), binary.BigEndian, &indx)
+	return
+}
+
+func parseTagx(data []byte) (tagx mobiTagx, err error) {
+	if len(data) < 12 || Peeker(data[:4]).magic() != magicTagx {
+		return tagx, errors.New("TAGX record not found at given offset")
+	}
+
+	buf := bytes.NewReader(data)
+	binary.Read(buf, binary.BigEndian, &tagx.Identifier)
+	binary.Read(buf, binary.BigEndian, &tagx.HeaderLenght)
+	if tagx.HeaderLenght < 12 {
+		return tagx, errors.New("TAGX record too short")
+	}
+	binary.Read(buf, binary.BigEndian, &tagx.ControlByteCount)
+
+	TagCount := (tagx.HeaderLenght - 12) / 4
+	tagx.Tags = make([]mobiTagxTags, TagCount)
+
+	if err = binary.Read(buf, binary.BigEndian, &tagx.Tags); err != nil {
+		return tagx, err
+	}
+	return tagx, nil
+}
+
+func parseIdxt(data []byte, IdxtCount uint32) (idxt mobiIdxt, err error) {
+	if len(data) < 4 || Peeker(data[:4]).magic() != magicIdxt {
+		return idxt, errors.New("IDXT record not found at given offset")
+	}
+
+	buf := bytes.NewReader(data)
+	binary.Read(buf, binary.BigEndian, &idxt.Identifier)
+
+	idxt.Offset = make([]uint16, IdxtCount)
+	err = binary.Read(buf, binary.BigEndian, &idxt.Offset)
+	return idxt, err
+}
+
+// parsePtagx decodes the control bytes and tag values of a single index entry
+func parsePtagx(tagx mobiTagx, data []byte) ([]mobiIndxEntry, error) {
+	//control_byte_count
+	//tagx
+	if len(data) < int(tagx.ControlByteCount) {
+		return nil, errors.New("Index entry is shorter than its control bytes")
+	}
+	controlBytes := data[:tagx.ControlByteCount]
+	data = data[tagx.ControlByteCount:]
+
+	var Ptagx []mobiPTagx //= make([]mobiPTagx, r.Tagx.TagCount())
+
+	for _, x := range tagx.Tags {
+		if x.ControlByte == 0x01 {
+			controlBytes = controlBytes[1:]
+			continue
+		}
+		if len(controlBytes) == 0 {
+			return nil, errors.New("Index entry is missing control bytes")
+		}
+
+		value := controlBytes[0] & x.Bitmask
+		if value != 0 {
+			var valCount uint32
+			var valBytes uint32
+
+			if value == x.Bitmask {
+				if setBits[x.Bitmask] > 1 {
+					// If all bits of masked value are set and the mask has more
+					// than one bit, a variable width value will follow after
+					// the control bytes which defines the length of bytes (NOT
+					// the value count!) which will contain the corresponding
+					// variable width values.
+					var consumed uint32
+					valBytes, consumed = vwiDec(data, true)
+					data = data[consumed:]
+				} else {
+					valCount = 1
+				}
+			} else {
+				mask := x.Bitmask
+				for {
+					if mask&1 != 0 {
+						break
+					}
+					mask >>= 1
+					value >>= 1
+				}
+				valCount = uint32(value)
+			}
+
+			Ptagx = append(Ptagx, mobiPTagx{x.Tag, x.TagNum, valCount, valBytes})
+		}
+	}
+
+	var IndxEntry []mobiIndxEntry
+	for _, x := range Ptagx {
+		if x.ValueCount != 0 {
+			// Read value_count * values_per_entry variable width values.
+			for i := 0; i < int(x.ValueCount)*int(x.TagValueCount); i++ {
+				if len(data) == 0 {
+					return nil, errors.New("Index entry is missing tag values")
+				}
+				byts, consumed := vwiDec(data, true)
+				data = data[consumed:]
+
+				IndxEntry = append(IndxEntry, mobiIndxEntry{x.Tag, byts})
+			}
+		} else {
+			// Convert value_bytes to variable width values.
+			totalConsumed := 0
+			for totalConsumed < int(x.ValueBytes) && len(data) > 0 {
+				byts, consumed := vwiDec(data, true)
+				data = data[consumed:]
+
+				totalConsumed += int(consumed)
+				IndxEntry = append(IndxEntry, mobiIndxEntry{x.Tag, byts})
+			}
+			if totalConsumed != int(x.ValueBytes) {
+				return nil, errors.New("Error not enough bytes are consumed. Consumed " + strconv.Itoa(totalConsumed) + " out of " + strconv.Itoa(int(x.ValueBytes)))
+			}
+		}
+	}
+
+	return IndxEntry, nil
+}
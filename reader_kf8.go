@@ -0,0 +1,247 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// mobiFdstEntry is a flow of the KF8 text: the HTML of all parts, followed by CSS and SVG flows
+type mobiFdstEntry struct {
+	Start uint32
+	End   uint32
+}
+
+// mobiKF8 is the KF8 part of a book. Record numbers in its headers are relative to Base.
+type mobiKF8 struct {
+	Base      uint32 // Record number of KF8 record 0
+	Pdh       mobiPDH
+	Header    mobiHeader
+	HeaderKF8 mobiHeaderKF8
+	Exth      mobiExth
+
+	Fdst     []mobiFdstEntry
+	Skeleton *mobiIndex
+	Fragment *mobiIndex
+}
+
+// HasKF8 reports whether the book has a KF8 part, either after the EXTH_KF8BOUNDARY or as the only format
+func (r *Reader) HasKF8() bool {
+	return r.mobi.KF8 != nil
+}
+
+// parseKF8 locates KF8 record 0 and reads its headers, FDST and the skeleton and fragment indexes.
+// In joint MOBI/KF8 books EXTH_KF8BOUNDARY points at it, in KF8 only books it is record 0.
+func (r *Reader) parseKF8() error {
+	var base uint32
+	if value, ok := r.mobi.Exth.Value(EXTH_KF8BOUNDARY); ok && len(value) == 4 && binary.BigEndian.Uint32(value) != uint32Max {
+		base = binary.BigEndian.Uint32(value)
+		if base == 0 || base >= uint32(r.mobi.Pdf.RecordsNum) {
+			return errors.New("KF8 boundary is out of bounds")
+		}
+
+		boundary, err := r.readRecord(base - 1)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(boundary, []byte(magicBoundary)) {
+			return errors.New("BOUNDARY record not found before KF8 record 0")
+		}
+	} else if r.mobi.Header.FileVersion < 8 {
+		return nil
+	}
+
+	rec, err := r.readRecord(base)
+	if err != nil {
+		return err
+	}
+	kf8, err := parseKF8Record0(rec)
+	if err != nil {
+		return err
+	}
+	kf8.Base = base
+
+	if n := kf8.Header.fdstRecordIndex(); n != uint32Max && n != 0 {
+		rec, err := r.readRecord(base + n)
+		if err != nil {
+			return err
+		}
+		if kf8.Fdst, err = parseFdst(rec); err != nil {
+			return err
+		}
+	}
+
+	if n := kf8.HeaderKF8.SkeletonIndex; n != uint32Max {
+		if kf8.Skeleton, err = r.readIndex(base + n); err != nil {
+			return err
+		}
+	}
+
+	if n := kf8.HeaderKF8.FragmentIndex; n != uint32Max {
+		if kf8.Fragment, err = r.readIndex(base + n); err != nil {
+			return err
+		}
+	}
+
+	r.mobi.KF8 = kf8
+	return nil
+}
+
+// parseKF8Record0 reads the PalmDoc header, the MOBI header with its KF8 extension and the EXTH of a KF8 record 0
+func parseKF8Record0(rec []byte) (*mobiKF8, error) {
+	kf8 := &mobiKF8{}
+	buf := bytes.NewReader(rec)
+
+	if err := binary.Read(buf, binary.BigEndian, &kf8.Pdh); err != nil {
+		return nil, err
+	}
+	if kf8.Pdh.Encryption != 0 {
+		return nil, errors.New("Records are encrypted")
+	}
+
+	if len(rec) < palmDocHeaderLen+4 || Peeker(rec[palmDocHeaderLen:palmDocHeaderLen+4]).magic() != magicMobi {
+		return nil, errors.New("Can not find KF8 MOBI header. File might be corrupt")
+	}
+	if err := binary.Read(buf, binary.BigEndian, &kf8.Header); err != nil {
+		return nil, err
+	}
+
+	kf8.HeaderKF8 = mobiHeaderKF8{uint32Max, uint32Max, uint32Max, uint32Max}
+	if kf8.Header.HeaderLength >= mobiHeaderKF8Len {
+		if err := binary.Read(buf, binary.BigEndian, &kf8.HeaderKF8); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasBit(int(kf8.Header.ExthFlags), 6) {
+		pos := palmDocHeaderLen + int(kf8.Header.HeaderLength)
+		if pos+4 > len(rec) || Peeker(rec[pos:pos+4]).magic() != magicExth {
+			return nil, errors.New("Can not read KF8 EXTH record")
+		}
+		if err := readExth(bytes.NewReader(rec[pos:]), &kf8.Exth); err != nil {
+			return nil, err
+		}
+	}
+
+	return kf8, nil
+}
+
+// parseFdst reads the flow table of a FDST record
+func parseFdst(rec []byte) ([]mobiFdstEntry, error) {
+	if len(rec) < 12 || Peeker(rec[:4]).magic() != magicFdst {
+		return nil, errors.New("FDST record not found at given offset")
+	}
+
+	pos := binary.BigEndian.Uint32(rec[4:])
+	count := binary.BigEndian.Uint32(rec[8:])
+	if uint64(pos)+uint64(count)*8 > uint64(len(rec)) {
+		return nil, errors.New("FDST entries are out of record bounds")
+	}
+
+	fdst := make([]mobiFdstEntry, count)
+	err := binary.Read(bytes.NewReader(rec[pos:]), binary.BigEndian, &fdst)
+	return fdst, err
+}
+
+// KF8RawML returns the decompressed text of the KF8 part, exactly as it is stored in the text records
+func (r *Reader) KF8RawML() ([]byte, error) {
+	kf8 := r.mobi.KF8
+	if kf8 == nil {
+		return nil, errors.New("Book has no KF8 part")
+	}
+	return r.rawML(kf8.Base, &kf8.Pdh, &kf8.Header)
+}
+
+// KF8Flows returns the flows of the KF8 text as listed in the FDST record. Flow 0 holds the
+// skeletons and fragments of all parts, the following flows hold CSS and SVG referenced as kindle:flow:N.
+func (r *Reader) KF8Flows() ([][]byte, error) {
+	text, err := r.KF8RawML()
+	if err != nil {
+		return nil, err
+	}
+	return splitFlows(text, r.mobi.KF8.Fdst)
+}
+
+// KF8Parts returns the HTML files of the KF8 text, rebuilt by inserting the fragments into their skeletons
+func (r *Reader) KF8Parts() ([][]byte, error) {
+	flows, err := r.KF8Flows()
+	if err != nil {
+		return nil, err
+	}
+
+	kf8 := r.mobi.KF8
+	if kf8.Skeleton == nil || kf8.Fragment == nil {
+		return nil, errors.New("KF8 skeleton or fragment index is missing")
+	}
+	return buildKF8Parts(flows[0], kf8.Skeleton, kf8.Fragment)
+}
+
+// splitFlows splits the KF8 text into flows. Without a flow table the text is a single flow.
+func splitFlows(text []byte, fdst []mobiFdstEntry) ([][]byte, error) {
+	if len(fdst) == 0 {
+		return [][]byte{text}, nil
+	}
+
+	flows := make([][]byte, len(fdst))
+	for i, f := range fdst {
+		if f.Start > f.End || int(f.End) > len(text) {
+			return nil, errors.New("FDST flow " + strconv.Itoa(i) + " is out of text bounds")
+		}
+		flows[i] = text[f.Start:f.End]
+	}
+	return flows, nil
+}
+
+// buildKF8Parts rebuilds the parts of the KF8 text. Each skeleton is followed in the text by its fragments,
+// which are inserted into the skeleton at the (text absolute) position stored as the fragment's label.
+func buildKF8Parts(text []byte, skel, frag *mobiIndex) ([][]byte, error) {
+	parts := make([][]byte, 0, len(skel.Entries))
+	next := 0
+
+	for i := range skel.Entries {
+		count, _ := skel.Entries[i].Value(tagSkelFragCount)
+		pos := skel.Entries[i].Values(tagSkelPos)
+		if len(pos) < 2 {
+			return nil, errors.New("Skeleton " + skel.Entries[i].Label + " has no position")
+		}
+
+		start, length := int(pos[0]), int(pos[1])
+		if start+length > len(text) {
+			return nil, errors.New("Skeleton " + skel.Entries[i].Label + " is out of text bounds")
+		}
+		part := append([]byte(nil), text[start:start+length]...)
+		ptr := start + length
+
+		for j := 0; j < int(count); j++ {
+			if next >= len(frag.Entries) {
+				return nil, errors.New("Skeleton " + skel.Entries[i].Label + " refers to missing fragments")
+			}
+			entry := &frag.Entries[next]
+			next++
+
+			insert, err := strconv.Atoi(entry.Label)
+			if err != nil {
+				return nil, errors.New("Fragment label is not an insert position: " + entry.Label)
+			}
+			geometry := entry.Values(tagFragPos)
+			if len(geometry) < 2 {
+				return nil, errors.New("Fragment " + entry.Label + " has no length")
+			}
+
+			insert -= start
+			length := int(geometry[1])
+			if insert < 0 || insert > len(part) || ptr+length > len(text) {
+				return nil, errors.New("Fragment " + entry.Label + " is out of bounds")
+			}
+
+			fragment := text[ptr : ptr+length]
+			part = append(part[:insert], append(append([]byte(nil), fragment...), part[insert:]...)...)
+			ptr += length
+		}
+
+		parts = append(parts, part)
+	}
+
+	return parts, nil
+}
@@ -0,0 +1,88 @@
+package mobi
+
+import "errors"
+
+// TBSEntry is the trailing byte sequence (TBS) of a text record. It lists the top level NCX entries found in the record,
+// which Kindle uses to move between chapters.
+type TBSEntry struct {
+	Index int  // First NCX entry found in the record
+	Count int  // Number of entries starting, ending or contained in the record, 0 if there is none
+	Spans bool // The entry starts before the record and ends after it
+}
+
+// TBS decodes the trailing byte sequences of the text records. It returns nil for books without them.
+func (r *Reader) TBS() ([]TBSEntry, error) {
+	flags := extraRecordDataFlags(&r.mobi.Header)
+	if flags&extraDataTBS == 0 {
+		return nil, nil
+	}
+
+	entries := make([]TBSEntry, r.mobi.Pdh.RecordCount)
+	for i := range entries {
+		rec, err := r.readRecord(uint32(i + 1))
+		if err != nil {
+			return nil, err
+		}
+		data, err := trailingEntryData(rec, flags, 1)
+		if err != nil {
+			return nil, err
+		}
+		if entries[i], err = decodeTBS(data); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// trailingEntryData returns the content of the trailing entry of a text record for flag bit BIT, without its size.
+// Bit 0, the multibyte entry, has no size of its own and is not supported.
+func trailingEntryData(rec []byte, flags uint32, bit uint) ([]byte, error) {
+	if bit == 0 {
+		return nil, errors.New("The multibyte entry has no size")
+	}
+	end := len(rec)
+	for b := uint(31); b >= bit; b-- {
+		if flags&(1<<b) == 0 {
+			continue
+		}
+		size := trailingEntrySize(rec[:end])
+		if size < 1 || size > end {
+			return nil, errors.New("Invalid trailing entry size")
+		}
+		if b == bit {
+			// The first byte of the size, which is encoded backwards, has the high bit set
+			n := 1
+			for n < size && rec[end-n]&0x80 == 0 {
+				n++
+			}
+			return rec[end-size : end-n], nil
+		}
+		end -= size
+	}
+	return nil, nil
+}
+
+// decodeTBS decodes the trailing byte sequence of a book (not a periodical)
+func decodeTBS(data []byte) (TBSEntry, error) {
+	if len(data) == 0 {
+		return TBSEntry{}, nil
+	}
+
+	val, n := vwiDec(data, true)
+	data = data[n:]
+	entry := TBSEntry{Index: int(val >> tbsFlagBits), Count: 1, Spans: val&tbsFlagSpans != 0}
+	if val&tbsFlagOffset != 0 {
+		if len(data) == 0 {
+			return entry, errors.New("Truncated trailing byte sequence")
+		}
+		_, n = vwiDec(data, true)
+		data = data[n:]
+	}
+	if val&tbsFlagCount != 0 {
+		if len(data) == 0 {
+			return entry, errors.New("Truncated trailing byte sequence")
+		}
+		entry.Count = int(data[0])
+	}
+	return entry, nil
+}
@@ -0,0 +1,491 @@
+package mobi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// buildTestBook writes a small book into memory and returns the builder used for the build along with the output
+func buildTestBook(t *testing.T, compression mobiPDHCompression) (*mobiBuilder, []byte) {
+	m := NewBuilder().(*mobiBuilder)
+	m.Title("Test Book")
+	m.Compression(compression)
+	m.NewExthRecord(EXTH_DOCTYPE, "EBOK")
+	m.NewExthRecord(EXTH_AUTHOR, "Book Author")
+
+	// Long chapters with multibyte characters, so that some of them end up split by record boundaries
+	text := strings.Repeat("<p>"+lipsum+" ÆØÅ – “quoted” ✓</p>", 3)
+	m.NewChapter("Chapter 1", []byte(text)).AddSubChapter("Chapter 1-1", []byte(text))
+	m.NewChapter("Chapter 2", []byte(text))
+
+	return writeTestBook(t, m)
+}
+
+// writeTestBook builds the book into memory. It returns the copy of the builder used for the build,
+// which holds the generated HTML and chapter offsets, along with the output.
+func writeTestBook(t *testing.T, m *mobiBuilder) (*mobiBuilder, []byte) {
+	built, err := m.build(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if _, err := (&Book{pdf: built.Pdf, records: built.records}).WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	return built, out.Bytes()
+}
+
+func openTestBook(t *testing.T, data []byte) *Reader {
+	r, err := NewReaderFrom(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestReadBackText(t *testing.T) {
+	for _, compression := range []mobiPDHCompression{CompressionNone, CompressionPalmDoc, CompressionHuffCdic} {
+		m, data := buildTestBook(t, compression)
+		r := openTestBook(t, data)
+
+		raw, err := r.RawML()
+		if err != nil {
+			t.Fatalf("compression %d: %v", compression, err)
+		}
+		if !bytes.Equal(raw, m.bookHTML.Bytes()) {
+			t.Errorf("compression %d: text read back differs from the text written (%d vs %d bytes)", compression, len(raw), m.bookHTML.Len())
+		}
+
+		text, err := r.Text()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(text, "“quoted” ✓") {
+			t.Errorf("compression %d: multibyte text was not decoded", compression)
+		}
+	}
+}
+
+func TestReadCorruptOffsets(t *testing.T) {
+	_, data := buildTestBook(t, CompressionPalmDoc)
+	last := int(binary.BigEndian.Uint16(data[76:])) - 1
+	setOffset := func(data []byte, n int, offset uint32) {
+		binary.BigEndian.PutUint32(data[palmDBHeaderLen+n*8:], offset)
+	}
+
+	cases := []struct {
+		name    string
+		corrupt func(data []byte)
+		record  uint32
+	}{
+		{"offsets going backwards", func(data []byte) { setOffset(data, 3, binary.BigEndian.Uint32(data[palmDBHeaderLen+8:])) }, 2},
+		{"offset past the end of the file", func(data []byte) { setOffset(data, 2, 0xFFFFFF00) }, 2},
+		{"last offset past the end of the file", func(data []byte) { setOffset(data, last, 0xFFFFFF00) }, uint32(last)},
+	}
+	for _, c := range cases {
+		corrupted := append([]byte(nil), data...)
+		c.corrupt(corrupted)
+		r := openTestBook(t, corrupted)
+
+		// The record is rejected before anything the size of the bogus record is allocated
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := r.readRecord(c.record)
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("%s: record %d was read", c.name, c.record)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%s: %d bytes allocated for record %d", c.name, allocated, c.record)
+		}
+		if _, err := r.RawML(); c.record != uint32(last) && err == nil {
+			t.Errorf("%s: text was read", c.name)
+		}
+	}
+}
+
+func TestPalmLZ77RoundTrip(t *testing.T) {
+	input := testData()
+	for _, resolver := range []func([]byte) lz77Resolver{newLZ77LookupResolver, newLZ77TreeResolver} {
+		out, err := palmLZ77Decompress(palmLZ77CompressWithResolver(input, resolver))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The trailing zero byte, marking the empty tail, is kept as is
+		if !bytes.Equal(out, input) {
+			t.Error("Decompressed data differs from the input")
+		}
+	}
+}
+
+func TestReadBackTOC(t *testing.T) {
+	m, data := buildTestBook(t, CompressionPalmDoc)
+	r := openTestBook(t, data)
+
+	toc, err := r.TOC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toc) == 0 || toc[0].FilePos != uint32(m.chapters[0].RecordOffset) || toc[0].Length != uint32(m.chapters[0].Len) {
+		t.Error("First TOC entry does not point to the first chapter")
+	}
+
+	var got []string
+	var walk func(entries []*TOCEntry, depth int)
+	walk = func(entries []*TOCEntry, depth int) {
+		for _, e := range entries {
+			if e.Depth != depth {
+				t.Errorf("%s: expected depth %d, got %d", e.Label, depth, e.Depth)
+			}
+			got = append(got, strings.Repeat("-", depth)+e.Label)
+			walk(e.Children, depth+1)
+		}
+	}
+	walk(toc, 0)
+
+	expected := []string{"Chapter 1", "-Chapter 1-1", "Chapter 2", "Table of Contents"}
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected TOC %v, got %v", expected, got)
+	}
+}
+
+func TestReadBackDeepTOC(t *testing.T) {
+	m := NewBuilder()
+	m.Title("Deep TOC")
+	m.Compression(CompressionNone)
+	part := m.NewChapter("Part 1", []byte("<p>Part</p>"))
+	ch := part.NewSubChapter("Chapter 1", []byte("<p>Chapter</p>"))
+	ch.NewSubChapter("Section 1.1", []byte("<p>Section</p>")).AddSubChapter("Section 1.1.1", []byte("<p>Subsection</p>"))
+	ch.AddSubChapter("Section 1.2", []byte("<p>Section</p>"))
+	part.AddSubChapter("Chapter 2", []byte("<p>Chapter</p>"))
+	m.NewChapter("Part 2", []byte("<p>Part</p>"))
+	m.KF8(true)
+
+	buf := new(bytes.Buffer)
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	r := openTestBook(t, buf.Bytes())
+
+	toc, err := r.TOC()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	var walk func(entries []*TOCEntry, depth int)
+	walk = func(entries []*TOCEntry, depth int) {
+		for _, e := range entries {
+			if e.Depth != depth {
+				t.Errorf("%s: expected depth %d, got %d", e.Label, depth, e.Depth)
+			}
+			got = append(got, strings.Repeat("-", depth)+e.Label)
+			walk(e.Children, depth+1)
+		}
+	}
+	walk(toc, 0)
+
+	expected := []string{"Part 1", "-Chapter 1", "--Section 1.1", "---Section 1.1.1", "--Section 1.2", "-Chapter 2", "Part 2", "Table of Contents"}
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected TOC %v, got %v", expected, got)
+	}
+
+	parts, err := r.KF8Parts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != len(expected) {
+		t.Errorf("Expected %d KF8 parts, got %d", len(expected), len(parts))
+	}
+}
+
+func TestLogger(t *testing.T) {
+	logs := new(bytes.Buffer)
+	logger := slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	m := NewBuilder()
+	m.Logger(logger)
+	m.NewChapter("Chapter 1", []byte("Some text here"))
+	out := new(bytes.Buffer)
+	if _, err := m.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "msg=\"Built book\"") {
+		t.Errorf("Builder did not log: %s", logs)
+	}
+
+	logs.Reset()
+	r, err := NewReaderFrom(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetLogger(logger)
+	if err = r.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "msg=\"Index entry\"") || !strings.Contains(logs.String(), "label=001") {
+		t.Errorf("Reader did not log the NCX entries: %s", logs)
+	}
+}
+
+func TestReadBackMetadata(t *testing.T) {
+	m := NewBuilder()
+	m.Title("Metadata Test")
+	m.NewExthRecord(EXTH_DOCTYPE, "EBOK")
+	m.NewExthRecord(EXTH_AUTHOR, "First Author")
+	m.NewExthRecord(EXTH_AUTHOR, "Second Author")
+	m.NewExthRecord(EXTH_ISBN, "9780000000002")
+	m.NewExthRecord(EXTH_PUBLISHINGDATE, "2019-05-31T00:00:00+00:00")
+	m.NewChapter("Chapter 1", []byte("Some text here"))
+
+	out := new(bytes.Buffer)
+	if _, err := m.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := openTestBook(t, out.Bytes()).Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "Metadata Test" || meta.DocType != "EBOK" || meta.ISBN != "9780000000002" {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+	if strings.Join(meta.Authors, ",") != "First Author,Second Author" {
+		t.Errorf("Unexpected authors %v", meta.Authors)
+	}
+	if meta.PublishingDate.Year() != 2019 || meta.PublishingDate.Month() != 5 {
+		t.Errorf("Unexpected publishing date %v", meta.PublishingDate)
+	}
+}
+
+func TestReadBackImages(t *testing.T) {
+	dir := t.TempDir()
+	cover := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, []byte("cover")...)
+	thumbnail := append([]byte("GIF89a"), []byte("thumbnail")...)
+	os.WriteFile(filepath.Join(dir, "cover.jpg"), cover, 0644)
+	os.WriteFile(filepath.Join(dir, "thumbnail.gif"), thumbnail, 0644)
+
+	m := NewBuilder()
+	m.Title("Image Test")
+	m.AddCover(filepath.Join(dir, "cover.jpg"), filepath.Join(dir, "thumbnail.gif"))
+	m.NewChapter("Chapter 1", []byte("Some text here"))
+
+	out := new(bytes.Buffer)
+	if _, err := m.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	r := openTestBook(t, out.Bytes())
+
+	images, err := r.Images()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].Format != ImageJPEG || images[1].Format != ImageGIF {
+		t.Fatalf("Unexpected images %+v", images)
+	}
+
+	img, err := r.Cover()
+	if err != nil || img == nil || !bytes.Equal(img.Data, cover) {
+		t.Errorf("Cover was not read back: %v", err)
+	}
+	img, err = r.Thumbnail()
+	if err != nil || img == nil || !bytes.Equal(img.Data, thumbnail) {
+		t.Errorf("Thumbnail was not read back: %v", err)
+	}
+}
+
+func TestReadBackTBS(t *testing.T) {
+	// Trailing entries of each text record, encoded as calibre encodes book TBS with 3 flag bits: the first chapter starts
+	// in record 1 and spans records 2 and 3, the short chapters are complete in record 4 where "Ending" starts,
+	// and the table of contents follows "Ending" in record 6.
+	expected := []struct {
+		data  []byte
+		entry TBSEntry
+	}{
+		{[]byte{0x82, 0x80, 0x83}, TBSEntry{Index: 0, Count: 1}},
+		{[]byte{0x83, 0x80, 0x80, 0x84}, TBSEntry{Index: 0, Count: 1, Spans: true}},
+		{[]byte{0x83, 0x80, 0x80, 0x84}, TBSEntry{Index: 0, Count: 1, Spans: true}},
+		{[]byte{0x86, 0x80, 0x07, 0x84}, TBSEntry{Index: 0, Count: 7}},
+		{[]byte{0xB3, 0x80, 0x80, 0x84}, TBSEntry{Index: 6, Count: 1, Spans: true}},
+		{[]byte{0xB6, 0x80, 0x02, 0x84}, TBSEntry{Index: 6, Count: 2}},
+	}
+
+	for _, compression := range []mobiPDHCompression{CompressionNone, CompressionPalmDoc, CompressionHuffCdic} {
+		m := NewBuilder().(*mobiBuilder)
+		m.Title("TBS Test")
+		m.Compression(compression)
+		m.NewChapter("Long", []byte(strings.Repeat("<p>"+lipsum+"</p>", 4))).AddSubChapter("Long-1", []byte("<p>Sub</p>"))
+		for i := 0; i < 5; i++ {
+			m.NewChapter(fmt.Sprintf("Short %d", i), []byte("<p>Short</p>"))
+		}
+		m.NewChapter("Ending", []byte(strings.Repeat("<p>"+lipsum+"</p>", 2)))
+		built, data := writeTestBook(t, m)
+		r := openTestBook(t, data)
+
+		if int(r.mobi.Pdh.RecordCount) != len(expected) {
+			t.Fatalf("compression %d: %d text records, expected %d", compression, r.mobi.Pdh.RecordCount, len(expected))
+		}
+		entries, err := r.TBS()
+		if err != nil {
+			t.Fatalf("compression %d: %v", compression, err)
+		}
+		for i, e := range expected {
+			rec, err := r.readRecord(uint32(i + 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(rec, e.data) {
+				t.Errorf("compression %d: record %d ends with % X, expected % X", compression, i+1, rec[len(rec)-len(e.data):], e.data)
+			}
+			if entries[i] != e.entry {
+				t.Errorf("compression %d: record %d has TBS %+v, expected %+v", compression, i+1, entries[i], e.entry)
+			}
+		}
+
+		raw, err := r.RawML()
+		if err != nil || !bytes.Equal(raw, built.bookHTML.Bytes()) {
+			t.Errorf("compression %d: text read back differs: %v", compression, err)
+		}
+	}
+}
+
+func TestBuildKF8Parts(t *testing.T) {
+	skel1, frag1 := `<html><body aid="0"></body></html>`, "<p>One</p>"
+	skel2, frag2, frag3 := `<html><body><div aid="1"></div></body></html>`, "<p>Two</p>", "<p>Three</p>"
+	text := []byte(skel1 + frag1 + skel2 + frag2 + frag3 + "p{}")
+
+	start2 := len(skel1) + len(frag1)
+	insert1 := strings.Index(skel1, "</body>")
+	insert2 := start2 + strings.Index(skel2, "</div>")
+
+	skel := &mobiIndex{Entries: []mobiIndexEntry{
+		{Label: "SKEL0000000", Tags: []mobiIndxEntry{{tagSkelFragCount, 1}, {tagSkelPos, 0}, {tagSkelPos, uint32(len(skel1))}}},
+		{Label: "SKEL0000001", Tags: []mobiIndxEntry{{tagSkelFragCount, 2}, {tagSkelPos, uint32(start2)}, {tagSkelPos, uint32(len(skel2))}}},
+	}}
+	frag := &mobiIndex{Entries: []mobiIndexEntry{
+		{Label: strconv.Itoa(insert1), Tags: []mobiIndxEntry{{tagFragPos, 0}, {tagFragPos, uint32(len(frag1))}}},
+		{Label: strconv.Itoa(insert2), Tags: []mobiIndxEntry{{tagFragPos, 0}, {tagFragPos, uint32(len(frag2))}}},
+		{Label: strconv.Itoa(insert2 + len(frag2)), Tags: []mobiIndxEntry{{tagFragPos, 0}, {tagFragPos, uint32(len(frag3))}}},
+	}}
+
+	flows, err := splitFlows(text, []mobiFdstEntry{{0, uint32(len(text) - 3)}, {uint32(len(text) - 3), uint32(len(text))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(flows[1]) != "p{}" {
+		t.Errorf("Expected CSS flow, got %q", flows[1])
+	}
+
+	parts, err := buildKF8Parts(flows[0], skel, frag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`<html><body aid="0"><p>One</p></body></html>`,
+		`<html><body><div aid="1"><p>Two</p><p>Three</p></div></body></html>`,
+	}
+	if len(parts) != len(expected) {
+		t.Fatalf("Expected %d parts, got %d", len(expected), len(parts))
+	}
+	for i := range parts {
+		if string(parts[i]) != expected[i] {
+			t.Errorf("Part %d: expected %q, got %q", i, expected[i], parts[i])
+		}
+	}
+}
+
+func TestParseFdst(t *testing.T) {
+	rec := []byte("FDST\x00\x00\x00\x0C\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x10\x00\x00\x00\x10\x00\x00\x00\x18")
+	fdst, err := parseFdst(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fdst) != 2 || fdst[0] != (mobiFdstEntry{0, 16}) || fdst[1] != (mobiFdstEntry{16, 24}) {
+		t.Errorf("Unexpected flow table %v", fdst)
+	}
+
+	if _, err := parseFdst(rec[:20]); err == nil {
+		t.Error("Expected an error for a truncated FDST record")
+	}
+}
+
+func TestReadBackKF8(t *testing.T) {
+	for _, compression := range []mobiPDHCompression{CompressionNone, CompressionPalmDoc, CompressionHuffCdic} {
+		m := NewBuilder().(*mobiBuilder)
+		m.Title("KF8 Book")
+		m.Compression(compression)
+		m.KF8(true)
+		m.CSS("h1 { color: red; }")
+		m.NewExthRecord(EXTH_DOCTYPE, "EBOK")
+
+		text := strings.Repeat("<p>"+lipsum+" ÆØÅ ✓</p>", 3)
+		m.NewChapter("Chapter 1", []byte(text)).AddSubChapter("Chapter 1-1", []byte("<p>Sub</p>"))
+		m.NewChapter("Chapter 2", []byte(text))
+
+		m, data := writeTestBook(t, m)
+		r := openTestBook(t, data)
+
+		// The MOBI6 part is unaffected
+		raw, err := r.RawML()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, m.bookHTML.Bytes()) {
+			t.Errorf("compression %d: MOBI6 text differs from the text written", compression)
+		}
+
+		if !r.HasKF8() {
+			t.Fatalf("compression %d: KF8 part not found", compression)
+		}
+
+		flows, err := r.KF8Flows()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(flows) != 2 || string(flows[1]) != "h1 { color: red; }" {
+			t.Errorf("compression %d: expected the CSS flow, got %d flows", compression, len(flows))
+		}
+
+		parts, err := r.KF8Parts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Chapter 1, Chapter 1-1, Chapter 2, Table of Contents
+		if len(parts) != 4 {
+			t.Fatalf("compression %d: expected 4 parts, got %d", compression, len(parts))
+		}
+		expected := `<body aid="0"><h1>Chapter 1</h1>` + text + `</body></html>`
+		if !strings.HasSuffix(string(parts[0]), expected) {
+			t.Errorf("compression %d: first part is not rebuilt correctly: %.200q", compression, parts[len(parts)-1])
+		}
+		if !strings.Contains(string(parts[0]), kf8StyleLink) {
+			t.Errorf("compression %d: stylesheet is not linked", compression)
+		}
+		if !strings.Contains(string(parts[3]), "<a href='kindle:pos:fid:0002:off:0000000000'>Chapter 2</a>") {
+			t.Errorf("compression %d: table of contents does not link with pos:fid: %q", compression, parts[3])
+		}
+
+		ncx, err := r.readIndex(r.mobi.KF8.Base + r.mobi.KF8.Header.IndxRecodOffset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ncx.Entries) != 4 {
+			t.Errorf("compression %d: expected 4 KF8 NCX entries, got %d", compression, len(ncx.Entries))
+		} else if fid := ncx.Entries[3].Values(tagEntryPosFid); len(fid) != 2 || fid[0] != 1 {
+			t.Errorf("compression %d: sub-chapter points to pos:fid %v", compression, fid)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package mobi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// RawML returns the decompressed markup of the book, exactly as it is stored in the text records
+func (r *Reader) RawML() ([]byte, error) {
+	return r.rawML(0, &r.mobi.Pdh, &r.mobi.Header)
+}
+
+// rawML reads the text records following record 0 of a book part at record BASE
+func (r *Reader) rawML(base uint32, pdh *mobiPDH, header *mobiHeader) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, pdh.TextLength))
+
+	for i := uint32(1); i <= uint32(pdh.RecordCount); i++ {
+		rec, err := r.readTextRecord(base+i, base, pdh, header)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(rec)
+	}
+
+	// TextLength is authoritative, records may contain padding at the very end
+	if pdh.TextLength > 0 && buf.Len() > int(pdh.TextLength) {
+		buf.Truncate(int(pdh.TextLength))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Text returns the markup of the book decoded into a string according to the book's TextEncoding
+func (r *Reader) Text() (string, error) {
+	raw, err := r.RawML()
+	if err != nil {
+		return "", err
+	}
+	return r.decodeString(raw), nil
+}
+
+// readTextRecord reads text record N, strips its trailing entries and decompresses it.
+// Record numbers in the header are relative to record 0 of the book part at record BASE.
+func (r *Reader) readTextRecord(n, base uint32, pdh *mobiPDH, header *mobiHeader) ([]byte, error) {
+	rec, err := r.readRecord(n)
+	if err != nil {
+		return nil, err
+	}
+
+	trail := trailingEntriesSize(rec, extraRecordDataFlags(header))
+	if trail > len(rec) {
+		return nil, errors.New("Trailing entries are larger than the record")
+	}
+	rec = rec[:len(rec)-trail]
+
+	switch pdh.Compression {
+	case CompressionNone:
+		return rec, nil
+	case CompressionPalmDoc:
+		return palmLZ77Decompress(rec)
+	case CompressionHuffCdic:
+		huff, err := r.huffcdicReader(base, header)
+		if err != nil {
+			return nil, err
+		}
+		return huff.Decompress(rec)
+	default:
+		return nil, errors.New("Unsupported compression type")
+	}
+}
+
+// huffcdicReader loads the HUFF and CDIC records on first use
+func (r *Reader) huffcdicReader(base uint32, header *mobiHeader) (*huffcdicReader, error) {
+	count := header.HuffmanRecordCount
+	if count == 0 || header.HuffmanRecordOffset == uint32Max {
+		return nil, errors.New("HUFF/CDIC records are missing")
+	}
+
+	first := base + header.HuffmanRecordOffset
+	if huff, ok := r.huff[first]; ok {
+		return huff, nil
+	}
+
+	huff, err := r.readRecord(first)
+	if err != nil {
+		return nil, err
+	}
+
+	cdics := make([][]byte, 0, count-1)
+	for i := first + 1; i < first+count; i++ {
+		cdic, err := r.readRecord(i)
+		if err != nil {
+			return nil, err
+		}
+		cdics = append(cdics, cdic)
+	}
+
+	reader, err := newHuffcdicReader(huff, cdics)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.huff == nil {
+		r.huff = make(map[uint32]*huffcdicReader)
+	}
+	r.huff[first] = reader
+	return reader, nil
+}
+
+// readRecord reads the full content of record N
+func (r *Reader) readRecord(n uint32) ([]byte, error) {
+	RecLen, err := r.OffsetToRecord(n)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := make([]byte, RecLen)
+	if _, err = io.ReadFull(r.file, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// extraRecordDataFlags returns ExtraRecordDataFlags if the header is long enough to contain them
+func extraRecordDataFlags(header *mobiHeader) uint32 {
+	if header.HeaderLength < 0xE4 || header.FileVersion < 5 {
+		return 0
+	}
+	return header.ExtraRecordDataFlags
+}
+
+// decodeString converts text stored in the book's encoding to a string
+func (r *Reader) decodeString(data []byte) string {
+	if r.mobi.Header.TextEncoding == EncCP1252 {
+		return decodeCP1252(data)
+	}
+	return string(data)
+}
+
+// trailingEntriesSize calculates the total size of trailing entries of a text record.
+// Entries are stored in reverse order of their flag bits, with the multibyte entry (bit 1) placed right after the text.
+func trailingEntriesSize(data []byte, flags uint32) int {
+	size := 0
+	for bit := uint(31); bit > 0; bit-- {
+		if flags&(1<<bit) == 0 {
+			continue
+		}
+		if size >= len(data) {
+			return size
+		}
+		size += trailingEntrySize(data[:len(data)-size])
+	}
+
+	if flags&1 != 0 && size < len(data) {
+		size += int(data[len(data)-size-1]&0x3) + 1
+	}
+	return size
+}
+
+// trailingEntrySize reads the backward encoded size of a trailing entry. The size includes itself.
+func trailingEntrySize(data []byte) int {
+	var size int
+	var bitPos uint
+	for i := len(data) - 1; i >= 0; i-- {
+		v := data[i]
+		size |= int(v&0x7F) << bitPos
+		bitPos += 7
+		if v&0x80 != 0 || bitPos >= 28 {
+			break
+		}
+	}
+	return size
+}
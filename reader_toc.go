@@ -0,0 +1,61 @@
+package mobi
+
+// TOCEntry is a node of the table of contents, as stored in the NCX index of a book
+type TOCEntry struct {
+	Label    string
+	FilePos  uint32 // Offset of the entry in the book's text (filepos)
+	Length   uint32 // Length of the entry's text
+	Depth    int
+	Children []*TOCEntry
+}
+
+// TOC returns the table of contents of the book as a tree. Books without an NCX index yield an empty TOC.
+func (r *Reader) TOC() ([]*TOCEntry, error) {
+	ncx := r.mobi.Ncx
+	if ncx == nil {
+		return nil, nil
+	}
+
+	nodes := make([]*TOCEntry, len(ncx.Entries))
+	for i := range ncx.Entries {
+		entry := &ncx.Entries[i]
+		node := &TOCEntry{}
+
+		node.FilePos, _ = entry.Value(tagEntryPos)
+		node.Length, _ = entry.Value(tagEntryLen)
+		depth, _ := entry.Value(tagEntryDepthLvl)
+		node.Depth = int(depth)
+
+		if offset, ok := entry.Value(tagEntryNameOffset); ok {
+			label, err := ncx.cncxString(offset)
+			if err != nil {
+				return nil, err
+			}
+			node.Label = r.decodeString(label)
+		}
+		nodes[i] = node
+	}
+
+	var roots []*TOCEntry
+	var last []*TOCEntry // Last node seen at each depth, for entries without a parent tag
+	for i, node := range nodes {
+		parent, hasParent := ncx.Entries[i].Value(tagEntryParent)
+		switch {
+		case hasParent && int(parent) < len(nodes) && int(parent) != i:
+			nodes[parent].Children = append(nodes[parent].Children, node)
+		case node.Depth > 0 && node.Depth <= len(last):
+			last[node.Depth-1].Children = append(last[node.Depth-1].Children, node)
+		default:
+			roots = append(roots, node)
+		}
+
+		if node.Depth < len(last) {
+			last = last[:node.Depth]
+		}
+		if node.Depth == len(last) {
+			last = append(last, node)
+		}
+	}
+
+	return roots, nil
+}
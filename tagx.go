@@ -11,6 +11,32 @@ var mobiTagxMap = map[tagEntry]mobiTagxTags{
 	tagEntryPosFid:     mobiTagxTags{6, 2, 128, 0},
 	tagEntryEND:        mobiTagxTags{0, 0, 0, 1}}
 
+// TAGX of the KF8 skeleton index. Values are written twice, as KindleGen does.
+var kf8SkelTagx = []mobiTagxTags{
+	{tagSkelFragCount, 1, 3, 0},
+	{tagSkelPos, 2, 12, 0},
+	mobiTagxMap[tagEntryEND]}
+
+// TAGX of the KF8 fragment index
+var kf8FragTagx = []mobiTagxTags{
+	{tagFragSelector, 1, 1, 0},
+	{tagFragFileNum, 1, 2, 0},
+	{tagFragSeqNum, 1, 4, 0},
+	{tagFragPos, 2, 8, 0},
+	mobiTagxMap[tagEntryEND]}
+
+// TAGX of the KF8 NCX index
+var kf8NcxTagx = []mobiTagxTags{
+	mobiTagxMap[tagEntryPos],
+	mobiTagxMap[tagEntryLen],
+	mobiTagxMap[tagEntryNameOffset],
+	mobiTagxMap[tagEntryDepthLvl],
+	mobiTagxMap[tagEntryParent],
+	mobiTagxMap[tagEntryChild1],
+	mobiTagxMap[tagEntryChildN],
+	mobiTagxMap[tagEntryPosFid],
+	mobiTagxMap[tagEntryEND]}
+
 type mobiTagx struct {
 	Identifier       [4]byte `format:"string"`
 	HeaderLenght     uint32  `init:"Tags" op:"-12 /4"`
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"log/slog"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -21,11 +23,13 @@ const (
 	lz77MinChunkLen = 3
 )
 
-var isNotSkipLog bool = true
+// discardLogger is used by readers and builders without a logger
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
 
-func SetSkipLog(flag bool) {
-	isNotSkipLog = !flag
-}
+// SetSkipLog has no effect. Logging is off by default; use Reader.SetLogger or Builder.Logger to turn it on.
+//
+// Deprecated: Set a logger on the Reader or Builder instead.
+func SetSkipLog(flag bool) {}
 
 func printStruct(x interface{}) {
 	ref := reflect.ValueOf(x)
@@ -195,3 +199,45 @@ func int32ToBytes(i uint32) []byte {
 	binary.Write(buf, binary.BigEndian, i)
 	return buf.Bytes()
 }
+
+// cp1252 maps the 0x80-0x9F range of CP-1252 to unicode. The rest of the code page matches ISO-8859-1.
+var cp1252 = [32]rune{
+	0x20AC, 0xFFFD, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0xFFFD, 0x017D, 0xFFFD,
+	0xFFFD, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0xFFFD, 0x017E, 0x0178,
+}
+
+// decodeCP1252 converts CP-1252 encoded text to a string
+func decodeCP1252(data []byte) string {
+	out := make([]rune, len(data))
+	for i, c := range data {
+		if c >= 0x80 && c < 0xA0 {
+			out[i] = cp1252[c-0x80]
+		} else {
+			out[i] = rune(c)
+		}
+	}
+	return string(out)
+}
+
+// encodeCP1252 converts a string to CP-1252. Characters missing from the code page are replaced by '?'.
+func encodeCP1252(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r < 0x80 || (r >= 0xA0 && r <= 0xFF):
+			out = append(out, byte(r))
+		default:
+			c := byte('?')
+			for i, x := range cp1252 {
+				if x == r && r != 0xFFFD {
+					c = byte(0x80 + i)
+					break
+				}
+			}
+			out = append(out, c)
+		}
+	}
+	return out
+}
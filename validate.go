@@ -0,0 +1,408 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Severity is the importance of an Issue found by Validate
+type Severity int
+
+const (
+	// SeverityWarning marks values which readers usually cope with, but which this package does not write
+	SeverityWarning Severity = iota
+	// SeverityError marks broken structures, which readers may refuse or misread
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Issue is a problem found by Validate
+type Issue struct {
+	Severity Severity
+	Record   int // Record the issue was found in, -1 for the Palm database header and the record list
+	Message  string
+}
+
+func (i Issue) String() string {
+	if i.Record < 0 {
+		return fmt.Sprintf("%s: header: %s", i.Severity, i.Message)
+	}
+	return fmt.Sprintf("%s: record %d: %s", i.Severity, i.Record, i.Message)
+}
+
+// Validate checks the structure of the MOBI file of size bytes read from r: the record list, record 0,
+// the text records, the NCX index, the EXTH header and the FLIS, FCIS and EOF records. It returns the
+// issues found, in file order, or nil if there is none. The KF8 part of joint files is not checked.
+func Validate(r io.ReaderAt, size int64) []Issue {
+	v := &validator{r: r, size: size}
+	if !v.recordList() {
+		return v.issues
+	}
+
+	rec0, ok := v.record(0)
+	if !ok {
+		return v.issues
+	}
+	pdh, header, ok := v.record0(rec0)
+	if !ok {
+		return v.issues
+	}
+
+	v.recordOrder(pdh, header)
+	v.textRecords(pdh, header)
+	if header.IndxRecodOffset != 0 && header.IndxRecodOffset != uint32Max {
+		v.index(int(header.IndxRecodOffset))
+	}
+	v.resourceRecords(pdh, header)
+	return v.issues
+}
+
+// validator holds the state of Validate
+type validator struct {
+	r       io.ReaderAt
+	size    int64
+	offsets []int64 // Start of each record
+	issues  []Issue
+}
+
+func (v *validator) add(severity Severity, record int, format string, args ...interface{}) {
+	v.issues = append(v.issues, Issue{Severity: severity, Record: record, Message: fmt.Sprintf(format, args...)})
+}
+
+// record reads record N. It returns false for records which do not exist or lie outside of the file.
+func (v *validator) record(n int) ([]byte, bool) {
+	if n < 0 || n >= len(v.offsets) {
+		return nil, false
+	}
+	start, end := v.offsets[n], v.size
+	if n+1 < len(v.offsets) {
+		end = v.offsets[n+1]
+	}
+	if start > end || end > v.size {
+		return nil, false
+	}
+
+	rec := make([]byte, end-start)
+	if read, err := v.r.ReadAt(rec, start); read < len(rec) {
+		v.add(SeverityError, n, "Can not read record: %v", err)
+		return nil, false
+	}
+	return rec, true
+}
+
+// recordList checks the Palm database header and the offsets of the records. It returns false if the records can not be found.
+func (v *validator) recordList() bool {
+	var pdf mobiPDF
+	if v.size < int64(palmDBHeaderLen) {
+		v.add(SeverityError, -1, "File is shorter than the Palm database header")
+		return false
+	}
+	binary.Read(io.NewSectionReader(v.r, 0, palmDBHeaderLen), binary.BigEndian, &pdf)
+	if pdf.RecordsNum == 0 {
+		v.add(SeverityError, -1, "RecordsNum is 0")
+		return false
+	}
+
+	listEnd := int64(recordListEnd(int(pdf.RecordsNum)))
+	if listEnd > v.size {
+		v.add(SeverityError, -1, "List of %d records ends past the end of the file", pdf.RecordsNum)
+		return false
+	}
+	list := make([]mobiRecordOffset, pdf.RecordsNum)
+	binary.Read(io.NewSectionReader(v.r, palmDBHeaderLen, listEnd-palmDBHeaderLen), binary.BigEndian, list)
+
+	valid := true
+	v.offsets = make([]int64, len(list))
+	for i, entry := range list {
+		v.offsets[i] = int64(entry.Offset)
+		switch {
+		case i == 0 && v.offsets[0] < listEnd:
+			// Records are listed up to the first one, a different count overlaps it
+			v.add(SeverityError, -1, "Record 0 starts at %d, but the list of RecordsNum %d records ends at %d", v.offsets[0], len(list), listEnd)
+			valid = false
+		case i == 0 && v.offsets[0] > listEnd:
+			v.add(SeverityWarning, -1, "Record 0 starts at %d, leaving a gap after the list of RecordsNum %d records, which ends at %d", v.offsets[0], len(list), listEnd)
+		case v.offsets[i] > v.size:
+			v.add(SeverityError, -1, "Record %d starts at %d, past the end of the file", i, v.offsets[i])
+			valid = false
+		case i > 0 && v.offsets[i] < v.offsets[i-1]:
+			v.add(SeverityError, -1, "Record %d starts at %d, before record %d", i, v.offsets[i], i-1)
+			valid = false
+		case i > 0 && v.offsets[i] == v.offsets[i-1]:
+			v.add(SeverityWarning, -1, "Record %d is empty", i-1)
+		}
+	}
+	return valid
+}
+
+// record0 checks the PalmDOC header, MOBI header and EXTH header of record 0
+func (v *validator) record0(rec []byte) (pdh mobiPDH, header mobiHeader, ok bool) {
+	pdhLen, headerLen := binary.Size(pdh), binary.Size(header)
+	if len(rec) < palmDocHeaderLen+8 {
+		v.add(SeverityError, 0, "Record 0 is too short for the PalmDOC and MOBI headers")
+		return pdh, header, false
+	}
+
+	// Fields past the length of the MOBI header read as zero
+	padded := make([]byte, pdhLen+headerLen)
+	copy(padded, rec)
+	binary.Read(bytes.NewReader(padded), binary.BigEndian, &pdh)
+	binary.Read(bytes.NewReader(padded[palmDocHeaderLen:]), binary.BigEndian, &header)
+
+	if string(header.Identifier[:]) != magicMobi.String() {
+		v.add(SeverityError, 0, "MOBI header is missing")
+		return pdh, header, false
+	}
+	if int(header.HeaderLength)+palmDocHeaderLen > len(rec) {
+		v.add(SeverityError, 0, "MOBI header length %d runs past the end of record 0", header.HeaderLength)
+		return pdh, header, false
+	}
+
+	switch pdh.Compression {
+	case CompressionNone, CompressionPalmDoc, CompressionHuffCdic:
+	default:
+		v.add(SeverityError, 0, "Unknown compression type %d", pdh.Compression)
+	}
+	if pdh.Encryption != 0 {
+		v.add(SeverityWarning, 0, "Book is encrypted")
+	}
+	if pdh.RecordSize != maxRecordSize {
+		v.add(SeverityWarning, 0, "Text record size is %d instead of %d", pdh.RecordSize, maxRecordSize)
+	}
+	if int(pdh.RecordCount) >= len(v.offsets) {
+		v.add(SeverityError, 0, "RecordCount %d text records do not fit in %d records", pdh.RecordCount, len(v.offsets))
+		pdh.RecordCount = uint16(len(v.offsets) - 1)
+	}
+	if need := (int(pdh.TextLength) + maxRecordSize - 1) / maxRecordSize; need != int(pdh.RecordCount) {
+		v.add(SeverityWarning, 0, "TextLength %d needs %d text records, RecordCount is %d", pdh.TextLength, need, pdh.RecordCount)
+	}
+
+	nameStart := int(header.FullNameOffset)
+	if hasBit(int(header.ExthFlags), 6) {
+		if end, ok := v.exth(rec, palmDocHeaderLen+int(header.HeaderLength)); ok && nameStart < end {
+			v.add(SeverityError, 0, "Full name at %d overlaps the EXTH header, which ends at %d", nameStart, end)
+		}
+	}
+	if nameStart+int(header.FullNameLength) > len(rec) {
+		v.add(SeverityError, 0, "Full name runs past the end of record 0")
+	}
+	return pdh, header, true
+}
+
+// exth checks the EXTH header starting at START of record 0 and returns its end, including the padding
+func (v *validator) exth(rec []byte, start int) (int, bool) {
+	if start+12 > len(rec) || string(rec[start:start+4]) != magicExth.String() {
+		v.add(SeverityError, 0, "EXTH flag is set, but the EXTH header is missing")
+		return 0, false
+	}
+	length := int(binary.BigEndian.Uint32(rec[start+4:]))
+	count := int(binary.BigEndian.Uint32(rec[start+8:]))
+
+	used := 12 // Header and records
+	for i := 0; i < count; i++ {
+		if start+used+8 > len(rec) {
+			v.add(SeverityError, 0, "EXTH record %d runs past the end of record 0", i)
+			return 0, false
+		}
+		recLen := int(binary.BigEndian.Uint32(rec[start+used+4:]))
+		if recLen < 8 {
+			v.add(SeverityError, 0, "EXTH record %d is shorter than its header", i)
+			return 0, false
+		}
+		used += recLen
+	}
+
+	// The length either leaves out the padding, as documented, or includes it, as written by most tools
+	size := length
+	if length == used {
+		size = used + padding4(used)
+	}
+	switch {
+	case length < used:
+		v.add(SeverityError, 0, "EXTH length %d is shorter than its %d records of %d bytes", length, count, used)
+		return 0, false
+	case start+size > len(rec):
+		v.add(SeverityError, 0, "EXTH header runs past the end of record 0")
+		return 0, false
+	case size%4 != 0:
+		v.add(SeverityWarning, 0, "EXTH header of %d bytes is not padded to a multiple of 4 bytes", size)
+	case size-used >= 4:
+		v.add(SeverityWarning, 0, "EXTH header has %d bytes of padding", size-used)
+	}
+	for _, b := range rec[start+used : start+size] {
+		if b != 0 {
+			v.add(SeverityWarning, 0, "EXTH padding is not zero")
+			break
+		}
+	}
+	return start + size, true
+}
+
+// recordOrder checks the record numbers of the MOBI header: the text records come first,
+// followed by the other records of the book, the images and the FLIS and FCIS records
+func (v *validator) recordOrder(pdh mobiPDH, header mobiHeader) {
+	count := uint32(len(v.offsets))
+	nonBook := header.FirstNonBookIndex
+	if nonBook != uint32Max && (nonBook <= uint32(pdh.RecordCount) || nonBook >= count) {
+		v.add(SeverityError, 0, "FirstNonBookIndex %d is not between the last text record %d and the last record %d", nonBook, pdh.RecordCount, count-1)
+	}
+
+	images := header.FirstImageIndex
+	if images != uint32Max && images != 0 {
+		if images >= count {
+			v.add(SeverityError, 0, "FirstImageIndex %d is past the last record %d", images, count-1)
+		}
+		if nonBook != uint32Max && images < nonBook {
+			v.add(SeverityError, 0, "FirstImageIndex %d comes before FirstNonBookIndex %d", images, nonBook)
+		}
+	}
+
+	// KF8 headers hold the FDST record number in the place of the content record numbers
+	if header.FileVersion >= 8 {
+		return
+	}
+	last := uint32(header.LastContentRecordNumber)
+	switch {
+	case last >= count:
+		v.add(SeverityError, 0, "LastContentRecordNumber %d is past the last record %d", last, count-1)
+	case last < uint32(pdh.RecordCount):
+		v.add(SeverityError, 0, "LastContentRecordNumber %d comes before the last text record %d", last, pdh.RecordCount)
+	case images != uint32Max && images != 0 && last < images:
+		v.add(SeverityError, 0, "LastContentRecordNumber %d comes before FirstImageIndex %d", last, images)
+	}
+	if header.FirstContentRecordNumber != 1 {
+		v.add(SeverityWarning, 0, "FirstContentRecordNumber is %d instead of 1", header.FirstContentRecordNumber)
+	}
+}
+
+// textRecords checks that the text records hold up to maxRecordSize bytes of text, followed by their trailing entries
+func (v *validator) textRecords(pdh mobiPDH, header mobiHeader) {
+	flags := extraRecordDataFlags(&header)
+	textLen := 0
+	for n := 1; n <= int(pdh.RecordCount); n++ {
+		rec, ok := v.record(n)
+		if !ok {
+			continue
+		}
+		trail := trailingEntriesSize(rec, flags)
+		if trail > len(rec) {
+			v.add(SeverityError, n, "Trailing entries of %d bytes are larger than the record", trail)
+			continue
+		}
+		if flags&extraDataTBS != 0 {
+			if data, err := trailingEntryData(rec, flags, 1); err != nil {
+				v.add(SeverityError, n, "%v", err)
+			} else if _, err := decodeTBS(data); err != nil {
+				v.add(SeverityWarning, n, "%v", err)
+			}
+		}
+
+		text := rec[:len(rec)-trail]
+		switch pdh.Compression {
+		case CompressionPalmDoc:
+			var err error
+			if text, err = palmLZ77Decompress(text); err != nil {
+				v.add(SeverityError, n, "Can not decompress the text: %v", err)
+				continue
+			}
+		case CompressionHuffCdic:
+			continue // The size of the text is only known once decoded with the HUFF and CDIC records
+		}
+		if len(text) > maxRecordSize {
+			v.add(SeverityError, n, "Record holds %d bytes of text, more than %d", len(text), maxRecordSize)
+		}
+		textLen += len(text)
+	}
+
+	if pdh.Compression != CompressionHuffCdic && textLen < int(pdh.TextLength) {
+		v.add(SeverityError, 0, "Text records hold %d bytes of text, less than TextLength %d", textLen, pdh.TextLength)
+	}
+}
+
+// index checks an index starting at record N: the INDX header and IDXT of its meta record and data records,
+// and that the data and CNCX records exist
+func (v *validator) index(n int) {
+	meta, ok := v.indexRecord(n)
+	if !ok {
+		return
+	}
+	for i := 1; i <= int(meta.IdxtCount); i++ {
+		v.indexRecord(n + i)
+	}
+	if last := n + int(meta.IdxtCount) + int(meta.CncxRecordsCount); last >= len(v.offsets) {
+		v.add(SeverityError, n, "Index data and CNCX records run past the last record %d", len(v.offsets)-1)
+	}
+}
+
+// indexRecord checks the INDX header of record N, and that the IDXT offsets point inside the record
+func (v *validator) indexRecord(n int) (mobiIndx, bool) {
+	var indx mobiIndx
+	rec, ok := v.record(n)
+	if !ok {
+		v.add(SeverityError, n, "Index record is missing")
+		return indx, false
+	}
+	if len(rec) < binary.Size(indx) || string(rec[:4]) != magicIndx.String() {
+		v.add(SeverityError, n, "INDX header is missing")
+		return indx, false
+	}
+	binary.Read(bytes.NewReader(rec), binary.BigEndian, &indx)
+
+	idxt := int(indx.IdxtOffset)
+	if idxt+4+int(indx.IdxtCount)*2 > len(rec) || string(rec[idxt:idxt+4]) != magicIdxt.String() {
+		v.add(SeverityError, n, "IDXT at %d with %d entries is not inside the record", idxt, indx.IdxtCount)
+		return indx, true
+	}
+	for i := 0; i < int(indx.IdxtCount); i++ {
+		off := int(binary.BigEndian.Uint16(rec[idxt+4+i*2:]))
+		if off < int(indx.HeaderLen) || off >= idxt {
+			v.add(SeverityError, n, "IDXT entry %d points at %d, outside of the entries", i, off)
+		}
+	}
+	return indx, true
+}
+
+// resourceRecords checks the FLIS and FCIS records and the EOF record which ends the book
+func (v *validator) resourceRecords(pdh mobiPDH, header mobiHeader) {
+	records := []struct {
+		index  uint32
+		magic  string
+		length int
+	}{
+		{header.FlisRecordIndex, "FLIS", binary.Size(mobiFlis{})},
+		{header.FcisRecordIndex, "FCIS", binary.Size(mobiFcis{})},
+	}
+	for _, r := range records {
+		if r.index == uint32Max || r.index == 0 {
+			v.add(SeverityWarning, 0, "No %s record", r.magic)
+			continue
+		}
+		rec, ok := v.record(int(r.index))
+		if !ok || len(rec) < 4 || string(rec[:4]) != r.magic {
+			v.add(SeverityError, int(r.index), "%s record is missing", r.magic)
+			continue
+		}
+		if len(rec) != r.length {
+			v.add(SeverityWarning, int(r.index), "%s record is %d bytes instead of %d", r.magic, len(rec), r.length)
+		}
+		if r.magic == "FCIS" && len(rec) >= 24 && binary.BigEndian.Uint32(rec[20:]) != pdh.TextLength {
+			v.add(SeverityWarning, int(r.index), "FCIS text length %d differs from TextLength %d", binary.BigEndian.Uint32(rec[20:]), pdh.TextLength)
+		}
+	}
+	if header.FlisRecordIndex != uint32Max && header.FcisRecordIndex != uint32Max && header.FcisRecordIndex != header.FlisRecordIndex+1 {
+		v.add(SeverityWarning, 0, "FCIS record %d does not follow FLIS record %d", header.FcisRecordIndex, header.FlisRecordIndex)
+	}
+
+	last := len(v.offsets) - 1
+	if rec, ok := v.record(last); !ok || !bytes.Equal(rec, []byte{0xE9, 0x8E, 0x0D, 0x0A}) {
+		v.add(SeverityWarning, last, "Book does not end with an EOF record")
+	}
+}
@@ -0,0 +1,131 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "cover.jpg"), append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, []byte("cover")...), 0644)
+
+	for _, compression := range []mobiPDHCompression{CompressionNone, CompressionPalmDoc, CompressionHuffCdic} {
+		for _, kf8 := range []bool{false, true} {
+			m := NewBuilder().(*mobiBuilder)
+			m.Title("Validate Test")
+			m.Compression(compression)
+			m.KF8(kf8)
+			m.NewExthRecord(EXTH_AUTHOR, "Book Author")
+			m.AddCover(filepath.Join(dir, "cover.jpg"), filepath.Join(dir, "cover.jpg"))
+			text := strings.Repeat("<p>"+lipsum+" ÆØÅ ✓</p>", 3)
+			m.NewChapter("Chapter 1", []byte(text)).AddSubChapter("Chapter 1-1", []byte(text))
+			m.NewChapter("Chapter 2", []byte(text))
+			_, data := writeTestBook(t, m)
+
+			if issues := Validate(bytes.NewReader(data), int64(len(data))); len(issues) != 0 {
+				t.Errorf("compression %d, KF8 %v: unexpected issues %v", compression, kf8, issues)
+			}
+		}
+	}
+
+	_, data := buildTestBook(t, CompressionPalmDoc)
+	last := int(binary.BigEndian.Uint16(data[76:])) - 1
+	offset := func(data []byte, n int) int {
+		return int(binary.BigEndian.Uint32(data[palmDBHeaderLen+n*8:]))
+	}
+	header := func(data []byte) *mobiHeader {
+		h := new(mobiHeader)
+		binary.Read(bytes.NewReader(data[offset(data, 0)+palmDocHeaderLen:]), binary.BigEndian, h)
+		return h
+	}
+	setHeader := func(data []byte, set func(h *mobiHeader)) []byte {
+		h := header(data)
+		set(h)
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, h)
+		copy(data[offset(data, 0)+palmDocHeaderLen:], buf.Bytes()[:h.HeaderLength])
+		return data
+	}
+	indx := int(header(data).IndxRecodOffset)
+
+	corruptions := []struct {
+		name     string
+		corrupt  func(data []byte) []byte
+		severity Severity
+		record   int
+		message  string
+	}{
+		{"records swapped", func(data []byte) []byte {
+			a, b := data[palmDBHeaderLen+2*8:palmDBHeaderLen+2*8+4], data[palmDBHeaderLen+3*8:palmDBHeaderLen+3*8+4]
+			tmp := append([]byte(nil), a...)
+			copy(a, b)
+			copy(b, tmp)
+			return data
+		}, SeverityError, -1, "Record 3 starts at"},
+		{"records count", func(data []byte) []byte {
+			binary.BigEndian.PutUint16(data[76:], binary.BigEndian.Uint16(data[76:])+1)
+			return data
+		}, SeverityError, -1, "RecordsNum"},
+		{"gap after the record list", func(data []byte) []byte {
+			for n := 0; n <= last; n++ {
+				binary.BigEndian.PutUint32(data[palmDBHeaderLen+n*8:], uint32(offset(data, n)+2))
+			}
+			end := recordListEnd(last + 1)
+			return append(append(data[:end:end], 0, 0), data[end:]...)
+		}, SeverityWarning, -1, "gap"},
+		{"text length", func(data []byte) []byte {
+			rec0 := offset(data, 0)
+			binary.BigEndian.PutUint32(data[rec0+4:], binary.BigEndian.Uint32(data[rec0+4:])+maxRecordSize)
+			return data
+		}, SeverityError, 0, "less than TextLength"},
+		{"EXTH length", func(data []byte) []byte {
+			exth := offset(data, 0) + palmDocHeaderLen + int(binary.BigEndian.Uint32(data[offset(data, 0)+palmDocHeaderLen+4:]))
+			binary.BigEndian.PutUint32(data[exth+4:], 12)
+			return data
+		}, SeverityError, 0, "EXTH length"},
+		{"first image before the non-book records", func(data []byte) []byte {
+			return setHeader(data, func(h *mobiHeader) { h.FirstImageIndex = h.FirstNonBookIndex - 1 })
+		}, SeverityError, 0, "FirstImageIndex"},
+		{"last content record before the text records", func(data []byte) []byte {
+			return setHeader(data, func(h *mobiHeader) { h.LastContentRecordNumber = 1 })
+		}, SeverityError, 0, "LastContentRecordNumber"},
+		{"IDXT offset", func(data []byte) []byte {
+			rec := data[offset(data, indx+1):offset(data, indx+2)]
+			idxt := binary.BigEndian.Uint32(rec[20:])
+			binary.BigEndian.PutUint16(rec[idxt+4:], 2)
+			return data
+		}, SeverityError, indx + 1, "IDXT entry 0 points at 2"},
+		{"FLIS index", func(data []byte) []byte {
+			return setHeader(data, func(h *mobiHeader) { h.FlisRecordIndex = 1 })
+		}, SeverityError, 1, "FLIS record is missing"},
+		{"FCIS index", func(data []byte) []byte {
+			return setHeader(data, func(h *mobiHeader) { h.FcisRecordIndex = uint32(last) })
+		}, SeverityError, last, "FCIS record is missing"},
+		{"EOF", func(data []byte) []byte {
+			return data[:len(data)-1]
+		}, SeverityWarning, last, "EOF"},
+	}
+	for _, c := range corruptions {
+		corrupted := c.corrupt(append([]byte(nil), data...))
+		issues := Validate(bytes.NewReader(corrupted), int64(len(corrupted)))
+		found := false
+		for _, issue := range issues {
+			if issue.Severity == c.severity && issue.Record == c.record && strings.Contains(issue.Message, c.message) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: expected %s in record %d about %q, got %v", c.name, c.severity, c.record, c.message, issues)
+		}
+	}
+
+	// A short read is reported against the record being read
+	issues := Validate(bytes.NewReader(data[:len(data)-2]), int64(len(data)))
+	if len(issues) == 0 || issues[0].Record != last || !strings.Contains(issues[0].Message, "Can not read") {
+		t.Errorf("Short read gave issues %v", issues)
+	}
+}
@@ -2,12 +2,19 @@ package mobi
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/fnv"
+	"html"
 	"io"
 	"io/ioutil"
-	"math/rand"
+	"log/slog"
+	"os"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -18,39 +25,63 @@ const (
 
 // Builder allows for building of MOBI book output
 type Builder interface {
-	AddCover(cover, thumbnail string)
-	Compression(i mobiPDHCompression)
+	AddCover(cover, thumbnail string) error
+	Compression(i mobiPDHCompression) error
+	CompressionStrategy(s CompressionStrategy) error
+	Workers(n int)
+	WorkerPool(p *WorkerPool)
 	CSS(css string)
-	NewExthRecord(recType ExthType, value interface{})
+	ImageResolver(r ImageResolver)
+	KF8(enable bool)
+	NewExthRecord(recType ExthType, value interface{}) error
 	Title(i string)
+	Timestamp(t time.Time)
+	DocumentID(id string)
+	Logger(l *slog.Logger)
+	OnProgress(fn func(p Progress))
 	NewChapter(title string, text []byte) Chapter
+	NewChapterReader(title string, r io.Reader) Chapter
+	NewChapterSource(title string, open func() (io.ReadCloser, error)) Chapter
+	Build() (*Book, error)
+	Chapters() []Chapter
+	FindChapter(id string) Chapter
+	Walk(fn func(ch Chapter, depth int) error) error
 	WriteTo(out io.Writer) (n int64, err error)
+	WriteToContext(ctx context.Context, out io.Writer) (n int64, err error)
+	WriteStream(out io.WriteSeeker) (n int64, err error)
 }
 
 // NewBuilder constructs a new builder
 func NewBuilder() Builder {
-	return &mobiBuilder{}
+	return &mobiBuilder{compression: CompressionNone, strategy: compressDefault}
 }
 
 // mobiBuilder allows for writing a mobi document
 type mobiBuilder struct {
 	timestamp   uint32
+	time        time.Time // Set by Timestamp, used instead of the current time
+	documentID  string    // Set by DocumentID, the unique ID of the book is derived from it
+	logger      *slog.Logger
+	progress    func(p Progress) // Set by OnProgress
 	title       string
 	compression mobiPDHCompression
+	strategy    CompressionStrategy // LZ77 strategy, compressDefault for the package default
+	workers     int                 // Goroutines compressing text records, runtime.NumCPU() if not set
+	pool        *WorkerPool         // Shared limit of records compressed at the same time, if set
 
-	chapterCount int
-	chapters     []mobiChapter
+	chapters []*mobiChapter
 
-	css string
+	css      string
+	kf8      bool          // Write a KF8 part after the MOBI6 part
+	resolver ImageResolver // Loads the images of <img> tags
 
 	bookHTML *bytes.Buffer
 
-	cncxBuffer      *bytes.Buffer
-	cncxLabelBuffer *bytes.Buffer
-
 	// Text records
 	records [][]byte
 
+	huff *huffcdicEncoder // Dictionary and codes used for CompressionHuffCdic
+
 	embedded []EmbeddedData
 	Mobi
 }
@@ -63,6 +94,8 @@ const (
 	EmbCover EmbType = iota
 	// EmbThumb is a thumbnail image
 	EmbThumb
+	// EmbImage is an image referenced by an <img> tag
+	EmbImage
 )
 
 // EmbeddedData holds an embedded blob
@@ -76,26 +109,26 @@ func (w *mobiBuilder) embed(FileType EmbType, Data []byte) int {
 	return len(w.embedded) - 1
 }
 
-//NewExthRecord adds a new exth record to the book
-func (w *mobiBuilder) NewExthRecord(recType ExthType, value interface{}) {
-	w.Exth.Add(uint32(recType), value)
+//NewExthRecord adds a new exth record to the book. It fails if the value does not suit the record type.
+func (w *mobiBuilder) NewExthRecord(recType ExthType, value interface{}) error {
+	return w.Exth.Add(uint32(recType), value)
 }
 
 // AddCover sets the cover image
 // cover and thumbnail are both filenames
-func (w *mobiBuilder) AddCover(cover, thumbnail string) {
+func (w *mobiBuilder) AddCover(cover, thumbnail string) error {
 	coverData, err := ioutil.ReadFile(cover)
 	if err != nil {
-		panic("Can not load file " + cover)
+		return errors.New("Can not load file " + cover + ": " + err.Error())
 	}
 	thumbnailData, err := ioutil.ReadFile(thumbnail)
 	if err != nil {
-		panic("Can not load file " + cover)
+		return errors.New("Can not load file " + thumbnail + ": " + err.Error())
 	}
 
 	w.embed(EmbCover, coverData)
 	w.embed(EmbThumb, thumbnailData)
-
+	return nil
 }
 
 // Title sets the title of the book being written
@@ -103,14 +136,125 @@ func (w *mobiBuilder) Title(i string) {
 	w.title = i
 }
 
+// Timestamp sets the creation and modification time written to the book. By default
+// it is taken from the SOURCE_DATE_EPOCH environment variable, or the current time.
+func (w *mobiBuilder) Timestamp(t time.Time) {
+	w.time = t
+}
+
+// DocumentID sets a stable key, such as a catalogue number, which the unique ID of the book is derived from.
+// Without it the ISBN or ASIN of the book is used, or else its title and text.
+// Kindle treats books with the same unique ID as the same document.
+func (w *mobiBuilder) DocumentID(id string) {
+	w.documentID = id
+}
+
+// Logger sets the logger the builder writes the details of the generated records to, at debug level.
+// Without a logger nothing is logged.
+func (w *mobiBuilder) Logger(l *slog.Logger) {
+	w.logger = l
+}
+
+func (w *mobiBuilder) log() *slog.Logger {
+	if w.logger == nil {
+		return discardLogger
+	}
+	return w.logger
+}
+
+// buildTime returns the time the book is built at
+func (w *mobiBuilder) buildTime() time.Time {
+	if !w.time.IsZero() {
+		return w.time
+	}
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0)
+	}
+	return time.Now()
+}
+
+// textHash returns the hash the unique ID of books without a key is derived from, once the text is written to it
+func (w *mobiBuilder) textHash() hash.Hash32 {
+	h := fnv.New32a()
+	h.Write([]byte(w.title))
+	h.Write([]byte{0})
+	return h
+}
+
+// uniqueID derives the unique ID of the book from its document ID, ISBN or ASIN, in that order.
+// Books without any of them get an ID derived from their title and text, as hashed by text.
+func (w *mobiBuilder) uniqueID(text hash.Hash32) uint32 {
+	h := fnv.New32a()
+	switch {
+	case w.documentID != "":
+		h.Write([]byte("id:" + w.documentID))
+	case w.exthKey(EXTH_ISBN) != nil:
+		h.Write(append([]byte("isbn:"), w.exthKey(EXTH_ISBN)...))
+	case w.exthKey(EXTH_ASIN) != nil:
+		h.Write(append([]byte("asin:"), w.exthKey(EXTH_ASIN)...))
+	default:
+		return text.Sum32()
+	}
+	return h.Sum32()
+}
+
+// exthKey returns the first non-empty EXTH record of the given type, or nil
+func (w *mobiBuilder) exthKey(recType uint32) []byte {
+	for _, value := range w.Exth.Values(recType) {
+		if len(value) > 0 {
+			return value
+		}
+	}
+	return nil
+}
+
 // CSS declares the stylesheet (if any) to use for the book
 func (w *mobiBuilder) CSS(css string) {
 	w.css = css
 }
 
+// KF8 sets whether a KF8 part is written after the MOBI6 part, for devices which support it.
+// Older devices keep reading the MOBI6 part.
+func (w *mobiBuilder) KF8(enable bool) {
+	w.kf8 = enable
+}
+
 // Compression sets the compression mode to use
-func (w *mobiBuilder) Compression(i mobiPDHCompression) {
-	w.compression = i
+func (w *mobiBuilder) Compression(i mobiPDHCompression) error {
+	switch i {
+	case CompressionNone, CompressionPalmDoc, CompressionHuffCdic:
+		w.compression = i
+		return nil
+	}
+	return errors.New("Unsupported compression type")
+}
+
+// CompressionStrategy sets the LZ77 compression strategy of this builder. Without it the
+// strategy set by SetCompressionStrategy is used.
+func (w *mobiBuilder) CompressionStrategy(s CompressionStrategy) error {
+	if !s.valid() {
+		return errors.New("Unsupported compression strategy")
+	}
+	w.strategy = s
+	return nil
+}
+
+func (w *mobiBuilder) compressionStrategy() CompressionStrategy {
+	if w.strategy == compressDefault {
+		return CompressionStrategy(defaultStrategy.Load())
+	}
+	return w.strategy
+}
+
+// Workers sets the number of goroutines compressing the text records of a book, runtime.NumCPU() by default
+func (w *mobiBuilder) Workers(n int) {
+	w.workers = n
+}
+
+// WorkerPool sets a pool shared with other builders, which limits the records compressed at the same time
+// by all of them. The workers of the builder wait for a free slot of the pool before compressing a record.
+func (w *mobiBuilder) WorkerPool(p *WorkerPool) {
+	w.pool = p
 }
 
 // AddRecord adds a new record. Returns Id
@@ -125,28 +269,77 @@ func (w *mobiBuilder) RecordCount() Mint {
 	return Mint(len(w.records))
 }
 
-// WriteTo will write the status of this MobiWriter to the provided Writer
+// WriteTo builds the book and writes it to the provided Writer. Use Build to write the same book more than once.
 func (w *mobiBuilder) WriteTo(out io.Writer) (n int64, err error) {
+	return w.WriteToContext(context.Background(), out)
+}
 
-	bw := &binaryWriter{out: out}
+// WriteToContext builds the book and writes it to out, like WriteTo. Building stops, with the error of ctx,
+// once ctx is done. Nothing is written to out then.
+func (w *mobiBuilder) WriteToContext(ctx context.Context, out io.Writer) (n int64, err error) {
+	b, err := w.build(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return (&Book{pdf: b.Pdf, records: b.records}).WriteTo(out)
+}
+
+// Build builds the book from the chapters, images and metadata added so far. The builder itself is left
+// unchanged, so it can be built again, with or without further changes.
+func (w *mobiBuilder) Build() (*Book, error) {
+	b, err := w.build(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &Book{pdf: b.Pdf, records: b.records}, nil
+}
+
+// build generates the records of the book on a copy of the builder, which it returns. It stops once ctx is done.
+func (w *mobiBuilder) build(ctx context.Context) (*mobiBuilder, error) {
+	w = w.clone()
 
 	w.createTOCChapter()
+	chapters := len(w.allChapters())
+	w.report(StageHTML, 0, chapters)
 
-	// Generate HTML file
+	// Generate HTML file. Chapters with a source are only read when their text is written.
+	images := make(map[string]int)
 	w.bookHTML = new(bytes.Buffer)
-	stylePart := ""
-	if len(w.css) > 0 {
-		stylePart = fmt.Sprintf("<style>%s</style>", w.css)
+	w.bookHTML.Write(w.htmlHead())
+	for _, ch := range w.allChapters() {
+		content, err := ch.content()
+		if err != nil {
+			return nil, err
+		}
+		if content, err = w.embedTextImages(content, images); err != nil {
+			return nil, err
+		}
+		if w.kf8 {
+			// The KF8 part is written from the content of the chapters
+			ch.HTML, ch.source = content, nil
+		}
+		ch.generateHTML(w.bookHTML, content)
+	}
+	w.bookHTML.WriteString(htmlFoot)
+
+	text, err := w.resolveLinks(w.bookHTML.Bytes())
+	if err != nil {
+		return nil, err
 	}
-	w.bookHTML.WriteString(fmt.Sprintf("<html><head>%s</head><body>", stylePart))
-	for i := range w.chapters {
-		w.chapters[i].generateHTML(w.bookHTML)
+	w.bookHTML = bytes.NewBuffer(text)
+	w.report(StageHTML, chapters, chapters)
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	w.bookHTML.WriteString("</body></html>")
 
 	// Generate MOBI
-	w.generateCNCX() // Generates CNCX
-	w.timestamp = uint32(time.Now().Unix())
+	w.timestamp = uint32(w.buildTime().Unix())
+	textHash := w.textHash()
+	textHash.Write(w.bookHTML.Bytes())
+	w.Pdf.UniqueIDSeed = w.uniqueID(textHash)
 
 	// Generate Records
 	// Record 0 - Reserve [Expand Record size in case Exth is modified by third party readers? 1024*10?]
@@ -155,16 +348,64 @@ func (w *mobiBuilder) WriteTo(out io.Writer) (n int64, err error) {
 	// Book Records
 	w.Pdh.TextLength = uint32(w.bookHTML.Len())
 
-	w.convertHTMLToRecords()
+	if err := w.convertHTMLToRecords(ctx); err != nil {
+		return nil, err
+	}
+	if err := w.addNonTextRecords(ctx); err != nil {
+		return nil, err
+	}
+	if w.records[0], err = w.record0(); err != nil {
+		return nil, err
+	}
+	w.log().Debug("Built book", "records", w.Pdf.RecordsNum, "exth_records", len(w.Exth.Records), "unique_id", w.Pdf.UniqueIDSeed)
+	return w, nil
+}
+
+// htmlFoot ends the book HTML, which starts with htmlHead
+const htmlFoot = "</body></html>"
 
+// htmlHead starts the book HTML, with the stylesheet if any
+func (w *mobiBuilder) htmlHead() []byte {
+	stylePart := ""
+	if len(w.css) > 0 {
+		stylePart = fmt.Sprintf("<style>%s</style>", w.css)
+	}
+	return []byte(fmt.Sprintf("<html><head>%s</head><body>", stylePart))
+}
+
+// addNonTextRecords adds the records following the text records: the NCX index, HUFF/CDIC, images,
+// FLIS, FCIS, the KF8 part and EOF. Record 0 is left to be written once the records are complete.
+func (w *mobiBuilder) addNonTextRecords(ctx context.Context) error {
+	if w.RecordCount()-1 > maxRecordCount {
+		return errors.New("Book has more than 65535 text records")
+	}
 	w.Pdh.RecordCount = w.RecordCount().UInt16() - 1
+	w.log().Debug("Text records", "first", 1, "count", w.Pdh.RecordCount, "text_length", w.Pdh.TextLength, "compression", w.compression)
 
 	// Index0
 	w.AddRecord([]uint8{0, 0})
 	w.Header.FirstNonBookIndex = w.RecordCount().UInt32()
 
-	w.generateINDX1()
-	w.generateINDX2()
+	// HUFF/CDIC
+	if w.huff != nil {
+		w.Header.HuffmanRecordOffset = w.AddRecord(w.huff.huffRecord()).UInt32()
+		for _, cdic := range w.huff.cdicRecords() {
+			w.AddRecord(cdic)
+		}
+		w.Header.HuffmanRecordCount = w.RecordCount().UInt32() - w.Header.HuffmanRecordOffset
+	}
+
+	chapters := len(w.allChapters())
+	w.report(StageIndex, 0, chapters)
+	if err := w.generateNCX(); err != nil {
+		return err
+	}
+	w.report(StageIndex, chapters, chapters)
+	w.log().Debug("NCX index", "record", w.Header.IndxRecodOffset, "records", w.RecordCount().UInt32()-w.Header.IndxRecodOffset)
+
+	// Images, followed by FLIS and FCIS
+	resources := len(w.embedded) + 2
+	w.report(StageResources, 0, resources)
 
 	// Image
 	//FirstImageIndex : array index
@@ -174,14 +415,21 @@ func (w *mobiBuilder) WriteTo(out io.Writer) (n int64, err error) {
 		//		c.Mh.FirstImageIndex = i + 2
 		for i, e := range w.embedded {
 			w.records = append(w.records, e.Data)
+			var err error
 			switch e.Type {
 			case EmbCover:
-				w.Exth.Add(EXTH_KF8COVERURI, fmt.Sprintf("kindle:embed:%04d", i+1))
-				w.Exth.Add(EXTH_COVEROFFSET, i)
+				if err = w.Exth.Add(EXTH_KF8COVERURI, "kindle:embed:"+toBase32(i+1, 4)); err == nil {
+					err = w.Exth.Add(EXTH_COVEROFFSET, i)
+				}
 			case EmbThumb:
-				w.Exth.Add(EXTH_THUMBOFFSET, i)
+				err = w.Exth.Add(EXTH_THUMBOFFSET, i)
 			}
+			if err != nil {
+				return err
+			}
+			w.report(StageResources, i+1, resources)
 		}
+		w.log().Debug("Image records", "first", w.Header.FirstImageIndex, "count", len(w.embedded))
 	} else {
 		w.Header.FirstImageIndex = uint32Max
 	}
@@ -192,69 +440,160 @@ func (w *mobiBuilder) WriteTo(out io.Writer) (n int64, err error) {
 	// w.Header.FirstImageIndex = 4294967295
 	// w.Header.FirstNonBookIndex = w.RecordCount().UInt32()
 	w.Header.LastContentRecordNumber = w.RecordCount().UInt16() - 1
-	w.Header.FlisRecordIndex = w.AddRecord(w.generateFlis()).UInt32() // Flis
-	w.Header.FcisRecordIndex = w.AddRecord(w.generateFcis()).UInt32() // Fcis
-	w.AddRecord([]byte{0xE9, 0x8E, 0x0D, 0x0A})                       // EOF
+	w.Header.FlisRecordIndex = w.AddRecord(w.generateFlis()).UInt32()                 // Flis
+	w.Header.FcisRecordIndex = w.AddRecord(w.generateFcis(w.Pdh.TextLength)).UInt32() // Fcis
+	w.report(StageResources, resources, resources)
+
+	if w.kf8 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := w.generateKF8(ctx); err != nil {
+			return err
+		}
+	}
+	w.AddRecord([]byte{0xE9, 0x8E, 0x0D, 0x0A}) // EOF
+	if w.RecordCount() > maxRecordCount {
+		return errors.New("Book has more than 65535 records")
+	}
 
-	w.initPDF(bw)
-	w.initPDH(bw)
-	w.initHeader(bw)
-	w.initExth(bw)
+	w.initPDF()
+	return nil
+}
 
-	bw.pad(1)
+// clone copies the builder, along with its chapters, images and EXTH records, so building
+// the book does not change the builder
+func (w *mobiBuilder) clone() *mobiBuilder {
+	b := *w
+	b.embedded = append([]EmbeddedData(nil), w.embedded...)
+	b.Exth.Records = append([]mobiExthRecord(nil), w.Exth.Records...)
+	b.records = nil
+
+	var cloneChapter func(ch, parent *mobiChapter) *mobiChapter
+	cloneChapter = func(ch, parent *mobiChapter) *mobiChapter {
+		c := *ch
+		c.parent = parent
+		c.subChapters = make([]*mobiChapter, len(ch.subChapters))
+		for i, sub := range ch.subChapters {
+			c.subChapters[i] = cloneChapter(sub, &c)
+		}
+		return &c
+	}
 
-	bw.Write([]byte(w.title))
-	_, err = bw.seekForwardTo((int(w.Pdh.RecordCount) * 8) + 1024*10)
-	if err != nil {
-		return bw.written(), err
+	b.chapters = make([]*mobiChapter, len(w.chapters))
+	for i, ch := range w.chapters {
+		b.chapters[i] = cloneChapter(ch, nil)
+		b.chapters[i].book = &b
 	}
-	for i := 1; i < w.RecordCount().Int(); i++ {
-		_, err := bw.Write(w.records[i])
-		if err != nil {
-			return bw.written(), err
-		}
+	return &b
+}
+
+// record0 writes record 0: the PalmDOC header, MOBI header, EXTH and the full name of the book
+func (w *mobiBuilder) record0() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	bw := &binaryWriter{out: buf}
+
+	if err := w.initPDH(bw); err != nil {
+		return nil, err
+	}
+	if err := w.initHeader(bw); err != nil {
+		return nil, err
+	}
+	if err := w.initExth(bw); err != nil {
+		return nil, err
+	}
+
+	if _, err := bw.pad(1); err != nil {
+		return nil, err
+	}
+	if _, err := bw.Write([]byte(w.title)); err != nil {
+		return nil, err
+	}
+
+	// Leave room for EXTH records added by third party tools, up to 10 KiB after the record list
+	start := recordListEnd(w.RecordCount().Int())
+	if _, err := bw.seekForwardTo((int(w.Pdh.RecordCount) * 8) + 1024*10 - start); err != nil {
+		return nil, err
 	}
-	return int64(bw.writtenBytes), nil
+	return buf.Bytes(), nil
 }
 
 func (w *mobiBuilder) createTOCChapter() {
-	chapters := w.chapterCount
+	// Chapters are numbered in reading order, the TOC chapter comes last
+	chapters := w.allChapters()
+	for i, ch := range chapters {
+		ch.Anchor = i
+	}
+
+	toc := tocHTML(w.chapters, func(ch *mobiChapter) string {
+		return fmt.Sprintf("#%d", ch.Anchor)
+	})
+	w.NewChapter("Table of Contents", toc).(*mobiChapter).Anchor = len(chapters)
+}
+
+// tocHTML lists links to the given chapters, using href to link to each chapter
+func tocHTML(chapters []*mobiChapter, href func(ch *mobiChapter) string) []byte {
 	buf := bytes.Buffer{}
-	if chapters > 0 {
-		for i := range w.chapters {
-			ch := w.chapters[i]
-			buf.WriteString(fmt.Sprintf("<a href='#%d'>%s</a><br>", ch.ID, ch.Title))
-		}
+	for _, ch := range chapters {
+		buf.WriteString(fmt.Sprintf("<a href='%s'>%s</a><br/>", href(ch), html.EscapeString(ch.title)))
 	}
-	w.NewChapter("Table of Contents", buf.Bytes())
+	return buf.Bytes()
 }
 
-func (w *mobiBuilder) convertHTMLToRecords() {
+func (w *mobiBuilder) convertHTMLToRecords(ctx context.Context) error {
+	html := w.bookHTML.Bytes()
+	records, huff, err := w.textRecords(ctx, html, tbsSequences(w.chapters, len(html)))
+	if err != nil {
+		return err
+	}
 
-	// Helper function to get the html in chunks of a useful size
-	nextChunk := func() []byte {
-		chunk := bytes.NewBuffer([]byte{})
-		for chunk.Len() < maxRecordSize {
-			// Read one character at a time to stay below the byte limit - or close to, at least
-			run, _, err := w.bookHTML.ReadRune()
-			if err == io.EOF {
-				break
-			}
-			chunk.WriteRune(run)
-		}
-		return chunk.Bytes()
+	w.huff = huff
+	for i := range records {
+		w.AddRecord(records[i])
 	}
+	return nil
+}
 
-	// Convert the bookHtml to nice and cozy chunks
+// textRecords converts text to (compressed) text records, with the trailing byte sequences in tbs if not nil.
+// The HUFF/CDIC encoder is returned for CompressionHuffCdic. It stops once ctx is done.
+func (w *mobiBuilder) textRecords(ctx context.Context, html []byte, tbs [][]byte) ([][]byte, *huffcdicEncoder, error) {
+	// Convert the bookHtml to nice and cozy chunks of exactly maxRecordSize bytes.
+	// A multibyte character split by the record boundary has its remaining bytes
+	// repeated as a trailing entry of the record.
 	chunks := [][]byte{}
-	for {
-		chunk := nextChunk()
-		if len(chunk) == 0 {
-			break
+	overlaps := [][]byte{}
+	for off := 0; off < len(html); off += maxRecordSize {
+		end := off + maxRecordSize
+		if end > len(html) {
+			end = len(html)
 		}
-		chunks = append(chunks, chunk)
+		chunks = append(chunks, html[off:end])
+		overlaps = append(overlaps, multibyteOverlap(html[end:]))
+	}
+
+	// HUFF/CDIC needs a dictionary of the whole book before any record can be compressed
+	var huff *huffcdicEncoder
+	if w.compression == CompressionHuffCdic {
+		huff = newHuffcdicEncoder(chunks)
+	}
+
+	w.report(StageCompression, 0, len(chunks))
+	done := 0
+	records, err := w.compressChunks(ctx, chunks, overlaps, tbs, huff, func() {
+		done++
+		w.report(StageCompression, done, len(chunks))
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	return records, huff, nil
+}
 
+// compressChunks converts chunks of text, with the multibyte overlap and trailing byte sequence of each, to text records.
+// Tbs is nil for records without trailing byte sequences.
+// The chunks are compressed in parallel, calling compressed after each of them, from one goroutine at a time.
+// Once ctx is done, the workers stop and the error of ctx is returned.
+func (w *mobiBuilder) compressChunks(ctx context.Context, chunks, overlaps, tbs [][]byte, huff *huffcdicEncoder, compressed func()) ([][]byte, error) {
 	// Convert chunks to records in parallel, but preserving the ordering
 	records := make([][]byte, len(chunks))
 
@@ -263,47 +602,87 @@ func (w *mobiBuilder) convertHTMLToRecords() {
 	// make a channel to send work to workers
 	ch := make(chan int)
 
-	// spin up workers
-	for i := 0; i < runtime.NumCPU(); i++ {
+	// spin up workers, which also take a slot of the shared pool for every record
+	workers := w.workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	strategy := w.compressionStrategy()
+	var mu sync.Mutex
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for i := range ch {
-				records[i] = makeHTMLRecord(chunks[i], w.compression)
+				if w.pool.acquire(ctx) != nil {
+					continue // cancelled, drain the remaining work
+				}
+				var seq []byte
+				if tbs != nil {
+					seq = tbs[i]
+				}
+				records[i] = w.makeHTMLRecord(chunks[i], overlaps[i], seq, huff, strategy)
+				w.pool.release()
+
+				mu.Lock()
+				compressed()
+				mu.Unlock()
 			}
 		}()
 	}
 
-	// Send them the work
+	// Send them the work, until cancelled
+send:
 	for i := range chunks {
-		ch <- i
+		select {
+		case ch <- i:
+		case <-ctx.Done():
+			break send
+		}
 	}
 
 	close(ch) // no more work
 	wg.Wait() // wait for the workers to finish
 
-	// Finally, add the records in order
-	for i := range records {
-		w.AddRecord(records[i])
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// multibyteOverlap returns the continuation bytes of a UTF-8 character at the start of the next record
+func multibyteOverlap(next []byte) []byte {
+	n := 0
+	for n < len(next) && n < 3 && next[n]&0xC0 == 0x80 {
+		n++
 	}
+	return next[:n]
 }
 
-// makeHTMLRecord converts a slice of the html data to a record
-func makeHTMLRecord(RecN []byte, compression mobiPDHCompression) []byte {
-	rLen := len(RecN)
-	if rLen == 0 {
+// makeHTMLRecord converts a slice of the html data to a record. The trailing byte sequence tbs is added
+// as a trailing entry unless it is nil.
+func (w *mobiBuilder) makeHTMLRecord(chunk, overlap, tbs []byte, huff *huffcdicEncoder, strategy CompressionStrategy) []byte {
+	if len(chunk) == 0 {
 		return []byte{}
 	}
 
-	if rLen > maxRecordSize { // If we overate and got too big
-		Trail := rLen - maxRecordSize    // get the size difference
-		RecN = append(RecN, byte(Trail)) // and put it at the end of the record, so we know how long the tail is
-	} else {
-		RecN = append(RecN, 0) // Otherwise, but a zero byte at the end
+	// Copy the chunk, so the trailing entry does not overwrite the following html
+	RecN := make([]byte, 0, len(chunk)+len(overlap)+1)
+	RecN = append(RecN, chunk...)
+	RecN = append(RecN, overlap...)         // Bytes of the character continuing in the next record
+	RecN = append(RecN, byte(len(overlap))) // and put the count at the end of the record, so we know how long the tail is
+
+	switch w.compression {
+	case CompressionPalmDoc:
+		RecN = palmLZ77Compress(RecN, strategy) // Optionally, compress that mofo with the chosen compression strategy
+	case CompressionHuffCdic:
+		// The trailing entry is kept outside of the huffman coded data
+		RecN = append(huff.Compress(chunk), RecN[len(chunk):]...)
 	}
 
-	if compression == CompressionPalmDoc {
-		RecN = palmLZ77Compress(RecN) // Optionally, compress that mofo with the chosen compression strategy
+	// The TBS follows the multibyte entry, outside of the compressed data
+	if tbs != nil {
+		RecN = append(RecN, trailingEntry(tbs)...)
 	}
 
 	return RecN // and then return it
@@ -314,228 +693,109 @@ func (w *mobiBuilder) EmbeddedCount() Mint {
 	return Mint(len(w.embedded))
 }
 
-func (w *mobiBuilder) generateCNCX() {
-	/*
-		Single  [Off, Len, Label, Depth]
-		Parent: [Off, Len, Label, Depth] + [FirstChild, Last Child]
-		Child:  [Off, Len, Label, Depth] + [Parent]
-
-
-		CNCX Structure
-		0. Header 1
-		1. Header 2 [Has children 3,4,5]
-		2. Header 3 [Has childred 6,7]
-		3. Child 1 of Header 2
-		4. Child 2 of Header 2
-		5. Child 3 of Header 2
-		6. Child 1 of Header 3
-		7. Child 2 of Header 3
-	*/
-	w.cncxLabelBuffer = new(bytes.Buffer)
-	w.cncxBuffer = new(bytes.Buffer)
-	w.chapterCount = 0
-
-	TagxSingle := []mobiTagxTags{
-		mobiTagxMap[tagEntryPos],
-		mobiTagxMap[tagEntryLen],
-		mobiTagxMap[tagEntryNameOffset],
-		mobiTagxMap[tagEntryDepthLvl],
-		mobiTagxMap[tagEntryEND]}
-
-	TagxParent := []mobiTagxTags{
-		mobiTagxMap[tagEntryPos],
-		mobiTagxMap[tagEntryLen],
-		mobiTagxMap[tagEntryNameOffset],
-		mobiTagxMap[tagEntryDepthLvl],
-		mobiTagxMap[tagEntryChild1],
-		mobiTagxMap[tagEntryChildN],
-		mobiTagxMap[tagEntryEND]}
-
-	TagxChild := []mobiTagxTags{
-		mobiTagxMap[tagEntryPos],
-		mobiTagxMap[tagEntryLen],
-		mobiTagxMap[tagEntryNameOffset],
-		mobiTagxMap[tagEntryDepthLvl],
-		mobiTagxMap[tagEntryParent],
-		mobiTagxMap[tagEntryEND]}
-
-	var id = len(w.chapters)
-
-	for _, node := range w.chapters {
-		if node.SubChapterCount() > 0 {
-			ch1 := id
-			chN := id + node.SubChapterCount() - 1
-			if isNotSkipLog {
-				fmt.Printf("Parent: %v %v %v [CHILDREN: %v %v]\n", id, node.SubChapterCount(), node.Title, ch1, chN)
-			}
-			id += node.SubChapterCount()
-
-			cncxID := fmt.Sprintf("%03v", id)
-
-			w.Idxt.Offset = append(w.Idxt.Offset, uint16(indxHeaderLen+w.cncxBuffer.Len()))
-
-			w.cncxBuffer.WriteByte(byte(len(cncxID)))              // Len of ID
-			w.cncxBuffer.WriteString(cncxID)                       // ID
-			w.cncxBuffer.WriteByte(controlByte(TagxParent)[0])     // Controll Byte
-			w.cncxBuffer.Write(vwiEncInt(node.RecordOffset))       // Record offset
-			w.cncxBuffer.Write(vwiEncInt(node.Len))                // Lenght of a record
-			w.cncxBuffer.Write(vwiEncInt(w.cncxLabelBuffer.Len())) // Label Offset // Offset relative to CNXC record
-			w.cncxLabelBuffer.Write(vwiEncInt(len(node.Title)))    // CNCXLabel lenght
-			w.cncxLabelBuffer.WriteString(node.Title)              // CNCXLabel title
-			w.cncxBuffer.Write(vwiEncInt(0))                       // Depth
-			w.cncxBuffer.Write(vwiEncInt(ch1))                     // Child1
-			w.cncxBuffer.Write(vwiEncInt(chN))                     // ChildN
-			w.chapterCount++
-		} else {
-			cncxID := fmt.Sprintf("%03v", w.chapterCount)
-			w.Idxt.Offset = append(w.Idxt.Offset, uint16(indxHeaderLen+w.cncxBuffer.Len()))
-
-			w.cncxBuffer.WriteByte(byte(len(cncxID)))              // Len of ID
-			w.cncxBuffer.WriteString(cncxID)                       // ID
-			w.cncxBuffer.WriteByte(controlByte(TagxSingle)[0])     // Controll Byte
-			w.cncxBuffer.Write(vwiEncInt(node.RecordOffset))       // Record offset
-			w.cncxBuffer.Write(vwiEncInt(node.Len))                // Lenght of a record
-			w.cncxBuffer.Write(vwiEncInt(w.cncxLabelBuffer.Len())) // Label Offset 	// Offset relative to CNXC record
-			w.cncxLabelBuffer.Write(vwiEncInt(len(node.Title)))    // CNCXLabel lenght
-			w.cncxLabelBuffer.WriteString(node.Title)              // CNCXLabel title
-			w.cncxBuffer.Write(vwiEncInt(0))                       // Depth
-			w.chapterCount++
-		}
-
-	}
-	id = len(w.chapters)
-
-	for i, node := range w.chapters {
-		for _, child := range node.SubChapters {
-			if isNotSkipLog {
-				fmt.Printf("Child: %v %v %v\n", id, i, child.Title)
-			}
-			cncxID := fmt.Sprintf("%03v", w.chapterCount)
-			w.Idxt.Offset = append(w.Idxt.Offset, uint16(indxHeaderLen+w.cncxBuffer.Len()))
-
-			w.cncxBuffer.WriteByte(byte(len(cncxID)))              // Len of ID
-			w.cncxBuffer.WriteString(cncxID)                       // ID
-			w.cncxBuffer.WriteByte(controlByte(TagxChild)[0])      // Controll Byte
-			w.cncxBuffer.Write(vwiEncInt(child.RecordOffset))      // Record offset
-			w.cncxBuffer.Write(vwiEncInt(child.Len))               // Lenght of a record
-			w.cncxBuffer.Write(vwiEncInt(w.cncxLabelBuffer.Len())) // Label Offset //Offset relative to CNXC record
-			w.cncxLabelBuffer.Write(vwiEncInt(len(child.Title)))   // CNCXLabel lenght
-			w.cncxLabelBuffer.WriteString(child.Title)             // CNCXLabel title
-			w.cncxBuffer.Write(vwiEncInt(1))                       // Depth
-			w.cncxBuffer.Write(vwiEncInt(i))                       // Parent
-			w.chapterCount++
-			id++
-		}
-	}
-}
-
-func (w *mobiBuilder) initPDF(bw *binaryWriter) *mobiBuilder {
+func (w *mobiBuilder) initPDF() *mobiBuilder {
 	stringToBytes(underlineTitle(w.title), &w.Pdf.DatabaseName) // Set Database Name
 	w.Pdf.CreationTime = w.timestamp                            // Set Time
 	w.Pdf.ModificationTime = w.timestamp                        // Set Time
 	stringToBytes("BOOK", &w.Pdf.Type)                          // Palm Database File Code
 	stringToBytes("MOBI", &w.Pdf.Creator)                       // *
-	w.Pdf.UniqueIDSeed = rand.New(rand.NewSource(9)).Uint32()   // UniqueID
 
 	w.Pdf.RecordsNum = w.RecordCount().UInt16()
-
-	bw.writeBinary(w.Pdf)
-
-	Oft := uint32((w.Pdf.RecordsNum * 8) + palmDBHeaderLen + 2)
-
-	for i := uint16(0); i < w.Pdf.RecordsNum; i++ {
-
-		bw.writeBinary(mobiRecordOffset{Offset: Oft, UniqueID: i}) // Write
-		if i == 0 {
-			Oft = (uint32(w.Pdh.RecordCount) * 8) + uint32(1024*10)
-		}
-		if i > 0 {
-			Oft += uint32(len(w.records[i]))
-		}
-	}
-
-	bw.pad(2)
-
 	return w
 }
 
-func (w *mobiBuilder) initPDH(bw *binaryWriter) *mobiBuilder {
+func (w *mobiBuilder) initPDH(bw *binaryWriter) error {
 	w.Pdh.Compression = w.compression
 	w.Pdh.RecordSize = maxRecordSize
 
-	bw.writeBinary(w.Pdh) // Write
-	return w
+	_, err := bw.writeBinary(w.Pdh) // Write
+	return err
 }
 
-func (w *mobiBuilder) initHeader(bw *binaryWriter) *mobiBuilder {
-	stringToBytes("MOBI", &w.Header.Identifier)
-	w.Header.HeaderLength = 232
-	w.Header.MobiType = 2
-	w.Header.TextEncoding = 65001
-	w.Header.UniqueID = w.Pdf.UniqueIDSeed + 1
+func (w *mobiBuilder) initHeader(bw *binaryWriter) error {
+	w.setHeaderDefaults(&w.Header)
+	w.Header.HeaderLength = mobiHeaderLen
 	w.Header.FileVersion = 6
 	w.Header.MinVersion = 6
-	w.Header.OrthographicIndex = uint32Max
-	w.Header.InflectionIndex = uint32Max
-	w.Header.IndexNames = uint32Max
-	w.Header.Locale = 1033
-	w.Header.IndexKeys = uint32Max
-	w.Header.ExtraIndex0 = uint32Max
-	w.Header.ExtraIndex1 = uint32Max
-	w.Header.ExtraIndex2 = uint32Max
-	w.Header.ExtraIndex3 = uint32Max
-	w.Header.ExtraIndex4 = uint32Max
-	w.Header.ExtraIndex5 = uint32Max
-	w.Header.ExthFlags = 80
-	w.Header.DrmOffset = uint32Max
-	w.Header.DrmCount = uint32Max
 	w.Header.FirstContentRecordNumber = 1
-	w.Header.FcisRecordCount = 1
-	w.Header.FlisRecordCount = 1
-
-	w.Header.Unknown7 = 0
-	w.Header.Unknown8 = 0
-
-	w.Header.SrcsRecordIndex = uint32Max
-	w.Header.SrcsRecordCount = 0
-
-	w.Header.Unknown9 = uint32Max
-	w.Header.Unknown10 = uint32Max
-	w.Header.ExtraRecordDataFlags = 1 //1
+	w.Header.ExtraRecordDataFlags = extraDataMultibyte | extraDataTBS
 
 	w.Header.FullNameLength = uint32(len(w.title))
 	w.Header.FullNameOffset = uint32(palmDocHeaderLen + mobiHeaderLen + w.Exth.GetHeaderLenght() + 1)
 
-	bw.writeBinary(w.Header) // Write
-	return w
+	_, err := bw.writeBinary(w.Header) // Write
+	return err
 }
 
-func (w *mobiBuilder) initExth(bw *binaryWriter) *mobiBuilder {
-	stringToBytes("EXTH", &w.Exth.Identifier)
-	w.Exth.HeaderLenght = 12
+// setHeaderDefaults sets the header fields shared by the MOBI6 and KF8 record 0
+func (w *mobiBuilder) setHeaderDefaults(h *mobiHeader) {
+	stringToBytes("MOBI", &h.Identifier)
+	h.MobiType = 2
+	h.TextEncoding = 65001
+	h.UniqueID = w.Pdf.UniqueIDSeed + 1
+	h.OrthographicIndex = uint32Max
+	h.InflectionIndex = uint32Max
+	h.IndexNames = uint32Max
+	h.Locale = 1033
+	h.IndexKeys = uint32Max
+	h.ExtraIndex0 = uint32Max
+	h.ExtraIndex1 = uint32Max
+	h.ExtraIndex2 = uint32Max
+	h.ExtraIndex3 = uint32Max
+	h.ExtraIndex4 = uint32Max
+	h.ExtraIndex5 = uint32Max
+	h.ExthFlags = 80
+	h.DrmOffset = uint32Max
+	h.DrmCount = uint32Max
+	h.FcisRecordCount = 1
+	h.FlisRecordCount = 1
+
+	h.Unknown7 = 0
+	h.Unknown8 = 0
+
+	h.SrcsRecordIndex = uint32Max
+	h.SrcsRecordCount = 0
+
+	h.Unknown9 = uint32Max
+	h.Unknown10 = uint32Max
+	h.ExtraRecordDataFlags = extraDataMultibyte
+}
+
+func (w *mobiBuilder) initExth(bw *binaryWriter) error {
+	return writeExth(bw, &w.Exth)
+}
 
-	for _, k := range w.Exth.Records {
-		w.Exth.HeaderLenght += k.RecordLength
+// writeExth writes the EXTH header and its records
+func writeExth(bw *binaryWriter, exth *mobiExth) error {
+	stringToBytes("EXTH", &exth.Identifier)
+	exth.HeaderLenght = 12
+
+	for _, k := range exth.Records {
+		exth.HeaderLenght += k.RecordLength
 	}
 
-	padding := w.Exth.HeaderLenght % 4
-	w.Exth.HeaderLenght += padding
+	padding := uint32(padding4(int(exth.HeaderLenght)))
+	exth.HeaderLenght += padding
 
-	w.Exth.RecordCount = uint32(len(w.Exth.Records))
+	exth.RecordCount = uint32(len(exth.Records))
 
-	bw.writeBinary(w.Exth.Identifier)
-	bw.writeBinary(w.Exth.HeaderLenght)
-	bw.writeBinary(w.Exth.RecordCount)
+	for _, v := range []interface{}{exth.Identifier, exth.HeaderLenght, exth.RecordCount} {
+		if _, err := bw.writeBinary(v); err != nil {
+			return err
+		}
+	}
 
-	for _, k := range w.Exth.Records {
-		bw.writeBinary(k.RecordType)
-		bw.writeBinary(k.RecordLength)
-		bw.writeBinary(k.Value)
+	for _, k := range exth.Records {
+		for _, v := range []interface{}{k.RecordType, k.RecordLength, k.Value} {
+			if _, err := bw.writeBinary(v); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Add zeros to reach multiples of 4 for the header
-	bw.pad(uint(padding))
-	return w
+	_, err := bw.pad(uint(padding))
+	return err
 }
 
 // binaryWriter keeps track of bytes written and allows for forward 'seek' operations
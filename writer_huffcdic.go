@@ -0,0 +1,377 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	// huffMaxCodeLen is the longest code the encoder assigns. Decoders support up to 32 bits.
+	huffMaxCodeLen = 24
+	// huffMaxPhraseLen limits the length of a single dictionary phrase
+	huffMaxPhraseLen = 32
+	// huffMaxPhrases limits the number of phrases picked from the text, on top of the 256 single bytes
+	huffMaxPhrases = 8192
+	// cdicBits is log2 of the number of phrases stored in each CDIC record
+	cdicBits = 10
+)
+
+// huffSymbol is a dictionary entry with its usage and assigned code
+type huffSymbol struct {
+	Phrase  []byte
+	Freq    int
+	CodeLen uint32
+	Code    uint32
+}
+
+// huffTrieNode is used to find the longest dictionary phrase at a given position
+type huffTrieNode struct {
+	next   map[byte]*huffTrieNode
+	symbol int // Index into huffcdicEncoder.symbols, -1 if no phrase ends here
+}
+
+// huffcdicEncoder compresses text records with a dictionary built from the whole book
+type huffcdicEncoder struct {
+	symbols []huffSymbol // Ordered as they are stored in the CDIC records
+	root    *huffTrieNode
+
+	minCode  [33]uint32 // Smallest code of each length
+	maxCode  [33]uint32 // Code of each length which maps to the lowest dictionary index, offset by that index
+	highCode [33]int64  // Highest code of each length, -1 if there are no codes of that length
+}
+
+// newHuffcdicEncoder builds a dictionary and huffman codes for the given text chunks
+func newHuffcdicEncoder(chunks [][]byte) *huffcdicEncoder {
+	h := &huffcdicEncoder{}
+
+	// Every single byte is in the dictionary, so any text can be encoded
+	for i := 0; i < 256; i++ {
+		h.symbols = append(h.symbols, huffSymbol{Phrase: []byte{byte(i)}})
+	}
+	h.symbols = append(h.symbols, pickHuffPhrases(chunks)...)
+	h.buildTrie()
+
+	// Count how often each symbol is used by the actual encoding
+	for _, chunk := range chunks {
+		h.tokenize(chunk, func(s int) { h.symbols[s].Freq++ })
+	}
+
+	// Phrases which lost to longer ones are never used, so they are dropped
+	used := h.symbols[:256]
+	for _, s := range h.symbols[256:] {
+		if s.Freq > 0 {
+			used = append(used, s)
+		}
+	}
+	h.symbols = used
+	for i := range h.symbols[:256] {
+		if h.symbols[i].Freq == 0 {
+			h.symbols[i].Freq = 1
+		}
+	}
+
+	h.assignCodes()
+	h.buildTrie()
+	return h
+}
+
+// pickHuffPhrases collects words and tags from the text and picks the ones that save the most space
+func pickHuffPhrases(chunks [][]byte) []huffSymbol {
+	counts := make(map[string]int)
+	for _, chunk := range chunks {
+		for i := 0; i < len(chunk); {
+			n := phraseLen(chunk[i:])
+			if n > 1 {
+				counts[string(chunk[i:i+n])]++
+				i += n
+			} else {
+				i++
+			}
+		}
+	}
+
+	var phrases []huffSymbol
+	for phrase, freq := range counts {
+		// Each use of a phrase saves roughly a byte per character, but the phrase is stored once
+		if freq > 1 && freq*(len(phrase)-1) > len(phrase)+2 {
+			phrases = append(phrases, huffSymbol{Phrase: []byte(phrase), Freq: freq})
+		}
+	}
+
+	sort.Slice(phrases, func(i, j int) bool {
+		si := phrases[i].Freq * (len(phrases[i].Phrase) - 1)
+		sj := phrases[j].Freq * (len(phrases[j].Phrase) - 1)
+		if si != sj {
+			return si > sj
+		}
+		return bytes.Compare(phrases[i].Phrase, phrases[j].Phrase) < 0
+	})
+	if len(phrases) > huffMaxPhrases {
+		phrases = phrases[:huffMaxPhrases]
+	}
+	for i := range phrases {
+		phrases[i].Freq = 0
+	}
+	return phrases
+}
+
+// phraseLen returns the length of a phrase candidate at the start of data: a whole tag, or a word with the following space
+func phraseLen(data []byte) int {
+	if data[0] == '<' {
+		for i := 1; i < len(data) && i < huffMaxPhraseLen; i++ {
+			if data[i] == '>' {
+				return i + 1
+			}
+		}
+		return 1
+	}
+
+	isWord := func(c byte) bool {
+		return c >= 0x80 || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	}
+	n := 0
+	for n < len(data) && n < huffMaxPhraseLen && isWord(data[n]) {
+		n++
+	}
+	if n > 0 && n < len(data) && n < huffMaxPhraseLen && data[n] == chSpace {
+		n++
+	}
+	return n
+}
+
+func (h *huffcdicEncoder) buildTrie() {
+	h.root = &huffTrieNode{symbol: -1}
+	for i, s := range h.symbols {
+		node := h.root
+		for _, c := range s.Phrase {
+			if node.next == nil {
+				node.next = make(map[byte]*huffTrieNode)
+			}
+			child, ok := node.next[c]
+			if !ok {
+				child = &huffTrieNode{symbol: -1}
+				node.next[c] = child
+			}
+			node = child
+		}
+		node.symbol = i
+	}
+}
+
+// tokenize splits data into the longest dictionary phrases, calling emit with each symbol index
+func (h *huffcdicEncoder) tokenize(data []byte, emit func(int)) {
+	for i := 0; i < len(data); {
+		node := h.root
+		symbol, length := -1, 0
+		for j := i; j < len(data); j++ {
+			node = node.next[data[j]]
+			if node == nil {
+				break
+			}
+			if node.symbol >= 0 {
+				symbol, length = node.symbol, j-i+1
+			}
+		}
+		emit(symbol)
+		i += length
+	}
+}
+
+// assignCodes computes length limited huffman codes, and orders the symbols as the decoder expects them.
+//
+// Longer codes have numerically smaller values. Symbols are stored sorted by code length, and within
+// a code length by descending code, so a code is translated to its index as maxCode[len] - code.
+func (h *huffcdicEncoder) assignCodes() {
+	freqs := make([]int, len(h.symbols))
+	for i, s := range h.symbols {
+		freqs[i] = s.Freq
+	}
+
+	lens := huffmanCodeLengths(freqs)
+	for lensMax(lens) > huffMaxCodeLen {
+		// Flatten the distribution until the tree is shallow enough
+		for i := range freqs {
+			freqs[i] = freqs[i]/2 + 1
+		}
+		lens = huffmanCodeLengths(freqs)
+	}
+	for i := range h.symbols {
+		h.symbols[i].CodeLen = lens[i]
+	}
+
+	// Order symbols by code length, ties are broken by position so the output is stable
+	sort.SliceStable(h.symbols, func(i, j int) bool {
+		return h.symbols[i].CodeLen < h.symbols[j].CodeLen
+	})
+
+	var count [33]int
+	var first [33]int // Index of the first symbol of each length
+	for i, s := range h.symbols {
+		if count[s.CodeLen] == 0 {
+			first[s.CodeLen] = i
+		}
+		count[s.CodeLen]++
+	}
+
+	// Assign codes starting from the longest ones
+	code := uint64(0)
+	for codeLen := huffMaxCodeLen; codeLen >= 1; codeLen-- {
+		h.minCode[codeLen] = uint32(code)
+		highest := code + uint64(count[codeLen])
+		for i := 0; i < count[codeLen]; i++ {
+			// Symbols with the highest code come first
+			highest--
+			h.symbols[first[codeLen]+i].Code = uint32(highest)
+		}
+		h.highCode[codeLen] = -1
+		if count[codeLen] > 0 {
+			h.highCode[codeLen] = int64(code) + int64(count[codeLen]) - 1
+			h.maxCode[codeLen] = uint32(h.highCode[codeLen]) + uint32(first[codeLen])
+		}
+		code += uint64(count[codeLen])
+		// Round up, so that shorter codes never share a prefix with longer ones
+		code = (code + 1) >> 1
+	}
+}
+
+// huffmanCodeLengths computes the code length of each symbol
+func huffmanCodeLengths(freqs []int) []uint32 {
+	type node struct {
+		freq   int
+		parent int
+	}
+
+	nodes := make([]node, len(freqs), len(freqs)*2)
+	leaves := make([]int, len(freqs))
+	for i, f := range freqs {
+		nodes[i] = node{freq: f, parent: -1}
+		leaves[i] = i
+	}
+	sort.SliceStable(leaves, func(i, j int) bool { return freqs[leaves[i]] < freqs[leaves[j]] })
+
+	// Two queue construction: sorted leaves and internal nodes, which are created in ascending order
+	var internal []int
+	pop := func() int {
+		if len(internal) == 0 || (len(leaves) > 0 && nodes[leaves[0]].freq <= nodes[internal[0]].freq) {
+			n := leaves[0]
+			leaves = leaves[1:]
+			return n
+		}
+		n := internal[0]
+		internal = internal[1:]
+		return n
+	}
+	for len(leaves)+len(internal) > 1 {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{freq: nodes[a].freq + nodes[b].freq, parent: -1})
+		nodes[a].parent = len(nodes) - 1
+		nodes[b].parent = len(nodes) - 1
+		internal = append(internal, len(nodes)-1)
+	}
+
+	// Depth of a node is the depth of its parent plus one. Parents are always created after their children.
+	depth := make([]uint32, len(nodes))
+	for i := len(nodes) - 2; i >= 0; i-- {
+		depth[i] = depth[nodes[i].parent] + 1
+	}
+	return depth[:len(freqs)]
+}
+
+func lensMax(lens []uint32) uint32 {
+	var max uint32
+	for _, l := range lens {
+		if l > max {
+			max = l
+		}
+	}
+	return max
+}
+
+// Compress encodes a chunk of text. The output is padded with zero bits, which never form a complete code.
+func (h *huffcdicEncoder) Compress(data []byte) []byte {
+	out := make([]byte, 0, len(data)/2)
+	var acc uint64
+	var bits uint
+
+	h.tokenize(data, func(s int) {
+		sym := h.symbols[s]
+		acc = acc<<sym.CodeLen | uint64(sym.Code)
+		bits += uint(sym.CodeLen)
+		for bits >= 8 {
+			bits -= 8
+			out = append(out, byte(acc>>bits))
+		}
+	})
+
+	if bits > 0 {
+		out = append(out, byte(acc<<(8-bits)))
+	}
+	return out
+}
+
+// huffRecord generates the HUFF record. It holds the code tables both in big and little endian.
+func (h *huffcdicEncoder) huffRecord() []byte {
+	var cache [256]uint32
+	for p := uint32(0); p < 256; p++ {
+		// Short codes are resolved from the first 8 bits alone
+		cache[p] = 9
+		for codeLen := uint32(1); codeLen <= 8; codeLen++ {
+			prefix := p >> (8 - codeLen)
+			if prefix >= h.minCode[codeLen] && int64(prefix) <= h.highCode[codeLen] {
+				cache[p] = h.maxCode[codeLen]<<8 | 0x80 | codeLen
+				break
+			}
+		}
+	}
+
+	var base [64]uint32
+	for codeLen := 1; codeLen <= 32; codeLen++ {
+		base[(codeLen-1)*2] = h.minCode[codeLen]
+		base[(codeLen-1)*2+1] = h.maxCode[codeLen]
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(magicHuff.String())
+	binary.Write(buf, binary.BigEndian, []uint32{
+		huffHeaderLen,                  // Header length
+		huffHeaderLen,                  // Big endian cache table
+		huffHeaderLen + 256*4,          // Big endian base table
+		huffHeaderLen + 256*4 + 64*4,   // Little endian cache table
+		huffHeaderLen + 256*4*2 + 64*4, // Little endian base table
+	})
+	binary.Write(buf, binary.BigEndian, cache)
+	binary.Write(buf, binary.BigEndian, base)
+	binary.Write(buf, binary.LittleEndian, cache)
+	binary.Write(buf, binary.LittleEndian, base)
+	return buf.Bytes()
+}
+
+// cdicRecords generates the CDIC records holding the dictionary phrases
+func (h *huffcdicEncoder) cdicRecords() [][]byte {
+	var records [][]byte
+	perRecord := 1 << cdicBits
+
+	for start := 0; start < len(h.symbols); start += perRecord {
+		end := start + perRecord
+		if end > len(h.symbols) {
+			end = len(h.symbols)
+		}
+
+		offsets := new(bytes.Buffer)
+		phrases := new(bytes.Buffer)
+		for _, s := range h.symbols[start:end] {
+			binary.Write(offsets, binary.BigEndian, uint16((end-start)*2+phrases.Len()))
+			binary.Write(phrases, binary.BigEndian, uint16(len(s.Phrase))|0x8000) // Phrases are stored uncompressed
+			phrases.Write(s.Phrase)
+		}
+
+		buf := new(bytes.Buffer)
+		buf.WriteString(magicCdic.String())
+		binary.Write(buf, binary.BigEndian, []uint32{cdicHeaderLen, uint32(len(h.symbols)), cdicBits})
+		buf.Write(offsets.Bytes())
+		buf.Write(phrases.Bytes())
+		records = append(records, buf.Bytes())
+	}
+	return records
+}
@@ -0,0 +1,170 @@
+package mobi
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ImageResolver loads the images referenced by <img src> in chapter HTML
+type ImageResolver interface {
+	Resolve(src string) ([]byte, error)
+}
+
+type fsResolver struct {
+	fsys fs.FS
+}
+
+// FSResolver resolves image sources as paths in fsys
+func FSResolver(fsys fs.FS) ImageResolver {
+	return fsResolver{fsys}
+}
+
+// Resolve reads the file at src, which may be percent encoded
+func (r fsResolver) Resolve(src string) ([]byte, error) {
+	if unescaped, err := url.PathUnescape(src); err == nil {
+		src = unescaped
+	}
+	return fs.ReadFile(r.fsys, path.Clean(strings.TrimPrefix(src, "/")))
+}
+
+// DirResolver resolves image sources as paths relative to dir
+func DirResolver(dir string) ImageResolver {
+	return fsResolver{os.DirFS(dir)}
+}
+
+// MapResolver resolves image sources from a map of source to image data
+type MapResolver map[string][]byte
+
+// Resolve returns the image stored under src
+func (r MapResolver) Resolve(src string) ([]byte, error) {
+	if data, ok := r[src]; ok {
+		return data, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+// Matches the src attribute of <img> tags. The attribute value is quoted with " or ', or not quoted at all.
+var imgSrcRegexp = regexp.MustCompile(`(?is)(<img\s[^>]*?)\bsrc\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+
+// Matches the recindex attribute of <img> tags written by embedTextImages
+var imgRecindexRegexp = regexp.MustCompile(`(?is)(<img\s[^>]*?)\brecindex\s*=\s*"(\d+)"`)
+
+// ImageResolver sets the resolver used to load the images referenced by <img> tags.
+// Without a resolver only images stored as data: URIs are embedded.
+func (w *mobiBuilder) ImageResolver(r ImageResolver) {
+	w.resolver = r
+}
+
+// embedTextImages rewrites the <img> tags of text to point at the image records, embedding the images
+// missing from indexes. Indexes maps the sources of the images embedded so far to their index.
+func (w *mobiBuilder) embedTextImages(text []byte, indexes map[string]int) ([]byte, error) {
+	var err error
+	text = imgSrcRegexp.ReplaceAllFunc(text, func(tag []byte) []byte {
+		m := imgSrcRegexp.FindSubmatch(tag)
+		src := html.UnescapeString(strings.Trim(string(m[2]), `"'`))
+
+		index, ok := indexes[src]
+		if !ok {
+			data, loadErr := w.loadImage(src)
+			if loadErr != nil {
+				if err == nil {
+					err = loadErr
+				}
+				return tag
+			}
+			if data == nil {
+				return tag
+			}
+			index = w.embed(EmbImage, data)
+			indexes[src] = index
+		}
+
+		// recindex is 1 based, the record at FirstImageIndex has recindex 1
+		return []byte(fmt.Sprintf(`%srecindex="%05d"`, m[1], index+1))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return text, nil
+}
+
+// loadImage loads the image of an <img> source. It returns nil, without error, for images
+// left as they are: external sources without a resolver.
+func (w *mobiBuilder) loadImage(src string) ([]byte, error) {
+	var data []byte
+	switch {
+	case strings.HasPrefix(src, "data:"):
+		var err error
+		if data, err = decodeDataURI(src); err != nil {
+			return nil, err
+		}
+	case w.resolver == nil:
+		return nil, nil
+	default:
+		var err error
+		if data, err = w.resolver.Resolve(src); err != nil {
+			return nil, errors.New("Can not load image " + src + ": " + err.Error())
+		}
+	}
+
+	if sniffImageFormat(data) == ImageUnknown {
+		return nil, errors.New("Unsupported image format: " + shortSrc(src))
+	}
+	return data, nil
+}
+
+// decodeDataURI decodes the data of a data: URI, either base64 or percent encoded
+func decodeDataURI(uri string) ([]byte, error) {
+	comma := strings.IndexByte(uri, ',')
+	if comma < 0 {
+		return nil, errors.New("Invalid data URI: " + shortSrc(uri))
+	}
+
+	meta, data := uri[len("data:"):comma], uri[comma+1:]
+	if strings.HasSuffix(strings.ToLower(meta), ";base64") {
+		// Data URIs in HTML attributes may be split over several lines
+		data = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, data)
+		out, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, errors.New("Invalid base64 in data URI: " + err.Error())
+		}
+		return out, nil
+	}
+
+	out, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, errors.New("Invalid data URI: " + err.Error())
+	}
+	return []byte(out), nil
+}
+
+// shortSrc shortens image sources for error messages, data: URIs can be very long
+func shortSrc(src string) string {
+	if len(src) > 64 {
+		return src[:64] + "..."
+	}
+	return src
+}
+
+// kf8Images rewrites the recindex attributes written by embedTextImages to the kindle:embed sources used by KF8
+func kf8Images(text []byte) []byte {
+	return imgRecindexRegexp.ReplaceAllFunc(text, func(tag []byte) []byte {
+		m := imgRecindexRegexp.FindSubmatch(tag)
+		index, _ := strconv.Atoi(string(m[2]))
+		return []byte(fmt.Sprintf(`%ssrc="kindle:embed:%s"`, m[1], toBase32(index, 4)))
+	})
+}
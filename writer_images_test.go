@@ -0,0 +1,59 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestEmbedImages(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', 0x0D, 0x0A, 0x1A, 0x0A, 1, 2, 3}
+	gif := []byte("GIF89a-inline")
+
+	m := NewBuilder()
+	m.Title("Image Test")
+	m.Compression(CompressionNone)
+	m.ImageResolver(MapResolver{"img/diagram.png": png})
+	m.NewChapter("Chapter 1", []byte(`<p><img alt="Diagram" src="img/diagram.png"/></p>`)).
+		AddSubChapter("Chapter 1-1", []byte(`<img src='img/diagram.png'><img src="data:image/gif;base64,`+base64.StdEncoding.EncodeToString(gif)+`">`))
+	m.KF8(true)
+
+	out := new(bytes.Buffer)
+	if _, err := m.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	r := openTestBook(t, out.Bytes())
+
+	images, err := r.Images()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || !bytes.Equal(images[0].Data, png) || !bytes.Equal(images[1].Data, gif) {
+		t.Fatalf("Unexpected images %+v", images)
+	}
+
+	text, err := r.Text()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(text, `recindex="00001"`) != 2 || !strings.Contains(text, `recindex="00002"`) || strings.Contains(text, "src=") {
+		t.Errorf("img tags were not rewritten: %s", text)
+	}
+
+	parts, err := r.KF8Parts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(parts[0], []byte(`src="kindle:embed:0001"`)) {
+		t.Errorf("KF8 img tags were not rewritten: %s", parts[0])
+	}
+
+	m = NewBuilder()
+	m.Compression(CompressionNone)
+	m.ImageResolver(MapResolver{})
+	m.NewChapter("Chapter 1", []byte(`<img src="missing.png">`))
+	if _, err := m.WriteTo(new(bytes.Buffer)); err == nil {
+		t.Error("Missing image did not fail the build")
+	}
+}
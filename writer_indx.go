@@ -3,123 +3,302 @@ package mobi
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"strconv"
 )
 
-func (w *mobiBuilder) chapterIsDeep() bool {
-	for _, node := range w.chapters {
-		if node.SubChapterCount() > 0 {
-			return true
+// tocNode is a chapter as listed in the NCX index. Top level chapters come first, followed by
+// the chapters of each following depth, so the children of a chapter are listed consecutively.
+type tocNode struct {
+	chapter *mobiChapter
+	depth   int
+	parent  int // Index of the parent node, -1 for top level chapters
+	child1  int // Index of the first child, -1 if the chapter has no sub-chapters
+	childN  int // Index of the last child
+}
+
+// tocNodes lists the chapters of the book breadth first
+func (w *mobiBuilder) tocNodes() []tocNode {
+	var nodes []tocNode
+	for _, ch := range w.chapters {
+		nodes = append(nodes, tocNode{chapter: ch, parent: -1, child1: -1, childN: -1})
+	}
+
+	for i := 0; i < len(nodes); i++ {
+		for _, sub := range nodes[i].chapter.subChapters {
+			if nodes[i].child1 < 0 {
+				nodes[i].child1 = len(nodes)
+			}
+			nodes[i].childN = len(nodes)
+			nodes = append(nodes, tocNode{chapter: sub, depth: nodes[i].depth + 1, parent: i, child1: -1, childN: -1})
 		}
 	}
-	return false
+	return nodes
 }
 
-func (w *mobiBuilder) generateINDX1() {
-	buf := new(bytes.Buffer)
-	// Tagx
-	tagx := mobiTagx{}
-	if w.chapterIsDeep() {
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryPos])
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryLen])
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryNameOffset])
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryDepthLvl])
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryParent])
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryChild1])
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryChildN])
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryEND])
-	} else {
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryPos])
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryLen])
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryNameOffset])
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryDepthLvl])
-		tagx.Tags = append(tagx.Tags, mobiTagxMap[tagEntryEND])
-	}
-
-	/*************************************/
-
-	/*************************************/
-	magicTagx.WriteTo(&tagx.Identifier)
-	tagx.ControlByteCount = 1
-	tagx.HeaderLenght = uint32(tagx.TagCount()*4) + 12
+// ncxEntries converts the TOC nodes to NCX entries, writing their titles into the CNCX record.
+// Pos returns the position tags of a chapter.
+func ncxEntries(nodes []tocNode, pos func(ch *mobiChapter) map[tagEntry][]uint32) ([]indexEntry, []byte) {
+	// Labels are zero padded numbers, so they sort in the order of the entries
+	width := len(strconv.Itoa(len(nodes) - 1))
+	if width < 3 {
+		width = 3
+	}
 
-	TagX := new(bytes.Buffer)
-	binary.Write(TagX, binary.BigEndian, tagx.Identifier)
-	binary.Write(TagX, binary.BigEndian, tagx.HeaderLenght)
-	binary.Write(TagX, binary.BigEndian, tagx.ControlByteCount)
-	binary.Write(TagX, binary.BigEndian, tagx.Tags)
+	cncx := new(bytes.Buffer)
+	entries := make([]indexEntry, len(nodes))
+	for i, node := range nodes {
+		values := pos(node.chapter)
+		values[tagEntryNameOffset] = []uint32{uint32(cncx.Len())}
+		values[tagEntryDepthLvl] = []uint32{uint32(node.depth)}
+		if node.parent >= 0 {
+			values[tagEntryParent] = []uint32{uint32(node.parent)}
+		}
+		if node.child1 >= 0 {
+			values[tagEntryChild1] = []uint32{uint32(node.child1)}
+			values[tagEntryChildN] = []uint32{uint32(node.childN)}
+		}
 
-	// Indx
-	//	IndxBin := new(bytes.Buffer)
-	indx := mobiIndx{}
-	magicIndx.WriteTo(&indx.Identifier)
-	indx.HeaderLen = indxHeaderLen
-	indx.IndxType = IndxTypeInflection
-	indx.IdxtCount = 1
-	indx.IdxtEncoding = EncUTF8
-	indx.SetUnk2 = uint32Max
-	indx.CncxRecordsCount = 1
-	indx.IdxtEntryCount = uint32(w.chapterCount)
-	indx.TagxOffset = indxHeaderLen
+		cncx.Write(vwiEncInt(len(node.chapter.title)))
+		cncx.WriteString(node.chapter.title)
+		entries[i] = indexEntry{Label: fmt.Sprintf("%0*d", width, i), Values: values}
+	}
+	return entries, cncx.Bytes()
+}
 
-	// Idxt
+// generateNCX adds the NCX index of the MOBI6 part, pointing to the chapters with filepos offsets
+func (w *mobiBuilder) generateNCX() error {
+	nodes := w.tocNodes()
 
-	/************/
+	// Books without sub-chapters do not need the hierarchy tags
+	tags := []mobiTagxTags{
+		mobiTagxMap[tagEntryPos],
+		mobiTagxMap[tagEntryLen],
+		mobiTagxMap[tagEntryNameOffset],
+		mobiTagxMap[tagEntryDepthLvl]}
+	if len(nodes) > len(w.chapters) {
+		tags = append(tags,
+			mobiTagxMap[tagEntryParent],
+			mobiTagxMap[tagEntryChild1],
+			mobiTagxMap[tagEntryChildN])
+	}
+	tags = append(tags, mobiTagxMap[tagEntryEND])
 
-	IdxtLast := len(w.Idxt.Offset)
-	Offset := w.Idxt.Offset[IdxtLast-1]
-	Rec := w.cncxBuffer.Bytes()[Offset-indxHeaderLen:]
+	entries, cncx := ncxEntries(nodes, func(ch *mobiChapter) map[tagEntry][]uint32 {
+		return map[tagEntry][]uint32{
+			tagEntryPos: {uint32(ch.RecordOffset)},
+			tagEntryLen: {uint32(ch.Len)},
+		}
+	})
 
-	Rec = Rec[0 : Rec[0]+1]
-	RLen := len(Rec)
+	records, err := indexRecords(tags, entries, cncx)
+	if err != nil {
+		return err
+	}
+	w.Header.IndxRecodOffset = w.AddRecord(records[0]).UInt32()
+	for _, rec := range records[1:] {
+		w.AddRecord(rec)
+	}
+	return nil
+}
 
-	Padding := (RLen + 2) % 4
+// indexEntry is an entry of an index being written. Values of a tag are written in TAGX order.
+type indexEntry struct {
+	Label  string
+	Values map[tagEntry][]uint32
+}
 
-	indx.IdxtOffset = indxHeaderLen + uint32(TagX.Len()) + uint32(RLen+2+Padding) // Offset to Idxt Record
-	/************/
+// maxIndexDataLen limits the entries of a data record, so their offsets fit the 16 bit IDXT
+const maxIndexDataLen = 0xFFFF - indxHeaderLen
 
-	binary.Write(buf, binary.BigEndian, indx)
-	buf.Write(TagX.Bytes())
-	buf.Write(Rec)
-	binary.Write(buf, binary.BigEndian, uint16(IdxtLast))
+// indexRecords builds the records of an index: the meta record, the data records holding the entries
+// and the CNCX record, if CNCX is not empty. Tags must end with tagEntryEND.
+func indexRecords(tags []mobiTagxTags, entries []indexEntry, cncx []byte) ([][]byte, error) {
+	var data [][][]byte // Encoded entries of each data record
+	var last []string   // Label of the last entry of each data record
+	var size int        // Bytes used by the entries and IDXT of the data record being filled
+	for _, entry := range entries {
+		enc := encodeIndexEntry(tags, entry)
+		if len(data) == 0 || size+len(enc)+2 > maxIndexDataLen-len(magicIdxt)-4 {
+			data = append(data, nil)
+			last = append(last, "")
+			size = 0
+		}
+		n := len(data) - 1
+		data[n] = append(data[n], enc)
+		last[n] = entry.Label
+		size += len(enc) + 2
+	}
 
-	buf.Write(make([]byte, Padding))
+	cncxCount := 0
+	if len(cncx) > 0 {
+		cncxCount = 1
+	}
 
-	buf.WriteString(magicIdxt.String())
+	counts := make([]int, len(data))
+	for i := range data {
+		counts[i] = len(data[i])
+	}
 
-	binary.Write(buf, binary.BigEndian, uint16(indxHeaderLen+uint32(TagX.Len())))
+	meta, err := indexMetaRecord(tags, len(entries), last, counts, cncxCount)
+	if err != nil {
+		return nil, err
+	}
 
-	buf.Write([]byte{0, 0})
-	w.Header.IndxRecodOffset = w.AddRecord(buf.Bytes()).UInt32()
+	records := [][]byte{meta}
+	for i := range data {
+		rec, err := indexDataRecord(data[i])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	if cncxCount > 0 {
+		records = append(records, cncx)
+	}
+	return records, nil
 }
 
-func (w *mobiBuilder) generateINDX2() {
+// encodeIndexEntry writes the label, control byte and tag values of an entry
+func encodeIndexEntry(tags []mobiTagxTags, entry indexEntry) []byte {
 	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(len(entry.Label)))
+	buf.WriteString(entry.Label)
+
+	var control []byte
+	var cb uint8
+	sizes := new(bytes.Buffer)  // Value byte counts of tags with more entries than the bitmask can hold
+	values := new(bytes.Buffer) // Values of all tags
+	for _, t := range tags {
+		if t.ControlByte == 1 {
+			control = append(control, cb)
+			cb = 0
+			continue
+		}
+
+		vals := entry.Values[t.Tag]
+		if len(vals) == 0 {
+			continue
+		}
+
+		start := values.Len()
+		for _, v := range vals {
+			values.Write(vwiEncInt(int(v)))
+		}
+
+		shift := maskToBitShifts[int(t.Bitmask)]
+		nentries := len(vals) / int(t.TagNum)
+		if setBits[t.Bitmask] > 1 && nentries >= int(t.Bitmask>>shift) {
+			// All bits set: the byte count of the values follows the control bytes
+			cb |= t.Bitmask
+			sizes.Write(vwiEncInt(values.Len() - start))
+		} else {
+			cb |= t.Bitmask & uint8(nentries<<shift)
+		}
+	}
+
+	buf.Write(control)
+	buf.Write(sizes.Bytes())
+	buf.Write(values.Bytes())
+	return buf.Bytes()
+}
+
+// indexTagx encodes the TAGX section of an index meta record
+func indexTagx(tags []mobiTagxTags) ([]byte, error) {
+	tagx := mobiTagx{Tags: tags}
+	if err := magicTagx.WriteTo(&tagx.Identifier); err != nil {
+		return nil, err
+	}
+	tagx.HeaderLenght = uint32(tagx.TagCount()*4) + 12
+	for _, t := range tags {
+		if t.ControlByte == 1 {
+			tagx.ControlByteCount++
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, tagx.Identifier)
+	binary.Write(buf, binary.BigEndian, tagx.HeaderLenght)
+	binary.Write(buf, binary.BigEndian, tagx.ControlByteCount)
+	binary.Write(buf, binary.BigEndian, tagx.Tags)
+	return buf.Bytes(), nil
+}
+
+// indexMetaRecord writes the meta record of an index. It lists the last label and the entry count of every data record.
+func indexMetaRecord(tags []mobiTagxTags, total int, last []string, counts []int, cncxCount int) ([]byte, error) {
+	tagx, err := indexTagx(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	geometry := new(bytes.Buffer)
+	var offsets []uint16
+	for i := range last {
+		offsets = append(offsets, uint16(indxHeaderLen+len(tagx)+geometry.Len()))
+		geometry.WriteByte(byte(len(last[i])))
+		geometry.WriteString(last[i])
+		binary.Write(geometry, binary.BigEndian, uint16(counts[i]))
+	}
+	geometry.Write(make([]byte, padding4(geometry.Len())))
+
 	indx := mobiIndx{}
-	magicIndx.WriteTo(&indx.Identifier)
+	if err := magicIndx.WriteTo(&indx.Identifier); err != nil {
+		return nil, err
+	}
 	indx.HeaderLen = indxHeaderLen
 	indx.IndxType = IndxTypeNormal
-	indx.Unk1 = 1
-	indx.IdxtEncoding = uint32Max
+	indx.IdxtOffset = uint32(indxHeaderLen + len(tagx) + geometry.Len())
+	indx.IdxtCount = uint32(len(last))
+	indx.IdxtEncoding = EncUTF8
 	indx.SetUnk2 = uint32Max
-	indx.IdxtOffset = uint32(indxHeaderLen + w.cncxBuffer.Len())
-	indx.IdxtCount = uint32(len(w.Idxt.Offset))
+	indx.IdxtEntryCount = uint32(total)
+	indx.CncxRecordsCount = uint32(cncxCount)
+	indx.TagxOffset = indxHeaderLen
 
+	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, indx)
-	buf.Write(w.cncxBuffer.Bytes())
+	buf.Write(tagx)
+	buf.Write(geometry.Bytes())
+	writeIdxt(buf, offsets)
+	return buf.Bytes(), nil
+}
 
-	buf.WriteString(magicIdxt.String())
-	for _, offset := range w.Idxt.Offset {
-		//Those offsets are not relative INDX record.
-		//So we need to adjust that.
-		binary.Write(buf, binary.BigEndian, offset) //+MOBI_INDX_HEADER_LEN)
+// indexDataRecord writes a data record of an index holding the given encoded entries
+func indexDataRecord(entries [][]byte) ([]byte, error) {
+	data := new(bytes.Buffer)
+	offsets := make([]uint16, len(entries))
+	for i, entry := range entries {
+		offsets[i] = uint16(indxHeaderLen + data.Len())
+		data.Write(entry)
 	}
 
-	Padding := (len(w.Idxt.Offset) + 4) % 4
-	for Padding != 0 {
-		buf.Write([]byte{0})
-		Padding--
+	indx := mobiIndx{}
+	if err := magicIndx.WriteTo(&indx.Identifier); err != nil {
+		return nil, err
 	}
+	indx.HeaderLen = indxHeaderLen
+	indx.IndxType = IndxTypeNormal
+	indx.Unk1 = 1
+	indx.IdxtOffset = uint32(indxHeaderLen + data.Len())
+	indx.IdxtCount = uint32(len(entries))
+	indx.IdxtEncoding = uint32Max
+	indx.SetUnk2 = uint32Max
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, indx)
+	buf.Write(data.Bytes())
+	writeIdxt(buf, offsets)
+	return buf.Bytes(), nil
+}
+
+// writeIdxt writes an IDXT section with the given offsets, padded to a multiple of 4 bytes
+func writeIdxt(buf *bytes.Buffer, offsets []uint16) {
+	buf.WriteString(magicIdxt.String())
+	binary.Write(buf, binary.BigEndian, offsets)
+	buf.Write(make([]byte, padding4(len(offsets)*2)))
+}
 
-	w.AddRecord(buf.Bytes())
-	w.AddRecord(w.cncxLabelBuffer.Bytes())
+// padding4 returns the number of bytes needed to pad N to a multiple of 4
+func padding4(n int) int {
+	return (4 - n%4) % 4
 }
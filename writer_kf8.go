@@ -0,0 +1,326 @@
+package mobi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+)
+
+// Skeleton of a KF8 file: title, stylesheet link and the aid of the body, which the fragment is inserted into
+const kf8Skeleton = `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>%s</title>%s</head><body aid="%s"></body></html>`
+
+// Link to the CSS flow, which follows the HTML flow in the KF8 text
+const kf8StyleLink = `<link href="kindle:flow:0001?mime=text/css" rel="stylesheet" type="text/css"/>`
+
+const base32Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUV"
+
+// kf8Part is a file of the KF8 text. Every chapter and sub-chapter gets its own file,
+// made of a skeleton and a single fragment holding the chapter, inserted into the body.
+type kf8Part struct {
+	chapter  *mobiChapter
+	skeleton []byte
+	fragment []byte
+	selector string // Selects the element the fragment is inserted into
+	insert   int    // Position of the fragment in the skeleton
+	start    int    // Position of the skeleton in the text. The fragment follows it.
+}
+
+// toBase32 formats N in the base 32 digits used by aid attributes and kindle: links, zero padded to width
+func toBase32(n, width int) string {
+	var buf []byte
+	for n > 0 || len(buf) == 0 {
+		buf = append([]byte{base32Digits[n%32]}, buf...)
+		n /= 32
+	}
+	if len(buf) < width {
+		buf = append(bytes.Repeat([]byte{'0'}, width-len(buf)), buf...)
+	}
+	return string(buf)
+}
+
+// kindlePosFid returns a link to offset OFF of fragment FID
+func kindlePosFid(fid, off int) string {
+	return fmt.Sprintf("kindle:pos:fid:%s:off:%s", toBase32(fid, 4), toBase32(off, 10))
+}
+
+// kf8Parts splits the book into KF8 files, one per chapter and sub-chapter in reading order.
+// The table of contents chapter (the last one) links to the other chapters with kindle:pos:fid links.
+// Internal links of the chapters are resolved as by resolveLinks, to kindle:pos:fid links.
+func (w *mobiBuilder) kf8Parts() ([]*kf8Part, error) {
+	chapters := w.allChapters()
+
+	fids := make(map[*mobiChapter]int, len(chapters))
+	for i, ch := range chapters {
+		fids[ch] = i
+	}
+
+	style := ""
+	if len(w.css) > 0 {
+		style = kf8StyleLink
+	}
+
+	// Links point at an offset of a fragment, the fragments are laid out one after the other
+	starts := make([]int, len(chapters))
+	links := newLinkResolver(chapters, func(pos int) string {
+		fid := sort.SearchInts(starts, pos+1) - 1
+		return `href="` + kindlePosFid(fid, pos-starts[fid]) + `"`
+	})
+
+	toc := w.chapters[len(w.chapters)-1]
+	texts := make([][]byte, len(chapters))
+	found := make([][]htmlLink, len(chapters))
+	pos := 0
+	for i, ch := range chapters {
+		body := kf8Images(ch.HTML)
+		if ch == toc {
+			body = tocHTML(w.chapters[:len(w.chapters)-1], func(ch *mobiChapter) string {
+				return kindlePosFid(fids[ch], 0)
+			})
+		}
+		texts[i] = append([]byte("<h1>"+html.EscapeString(ch.title)+"</h1>"), body...)
+
+		var err error
+		if found[i], err = links.findLinks(texts[i]); err != nil {
+			return nil, err
+		}
+		starts[i] = pos
+		pos += links.addAnchors(texts[i], found[i], ch, pos)
+	}
+
+	parts := make([]*kf8Part, len(chapters))
+	start := 0
+	for i, ch := range chapters {
+		fragment := new(bytes.Buffer)
+		if err := links.rewrite(fragment, texts[i], found[i], ch); err != nil {
+			return nil, err
+		}
+
+		aid := toBase32(i, 0)
+		p := &kf8Part{chapter: ch, start: start}
+		p.skeleton = []byte(fmt.Sprintf(kf8Skeleton, html.EscapeString(ch.title), style, aid))
+		p.fragment = fragment.Bytes()
+		p.selector = fmt.Sprintf("P-//*[@aid='%s']", aid)
+		p.insert = bytes.LastIndex(p.skeleton, []byte("</body>"))
+
+		start += len(p.skeleton) + len(p.fragment)
+		parts[i] = p
+	}
+	return parts, nil
+}
+
+// kf8Text joins the skeletons and fragments into the HTML flow, followed by the CSS flow. It returns the text and its flow table.
+func (w *mobiBuilder) kf8Text(parts []*kf8Part) ([]byte, []mobiFdstEntry) {
+	buf := new(bytes.Buffer)
+	for _, p := range parts {
+		buf.Write(p.skeleton)
+		buf.Write(p.fragment)
+	}
+
+	fdst := []mobiFdstEntry{{0, uint32(buf.Len())}}
+	if len(w.css) > 0 {
+		buf.WriteString(w.css)
+		fdst = append(fdst, mobiFdstEntry{fdst[0].End, uint32(buf.Len())})
+	}
+	return buf.Bytes(), fdst
+}
+
+// kf8SkeletonIndex lists the skeletons: their position in the text and their fragment count
+func kf8SkeletonIndex(parts []*kf8Part) ([][]byte, error) {
+	entries := make([]indexEntry, len(parts))
+	for i, p := range parts {
+		start, length := uint32(p.start), uint32(len(p.skeleton))
+		entries[i] = indexEntry{
+			Label: fmt.Sprintf("SKEL%010d", i),
+			Values: map[tagEntry][]uint32{
+				tagSkelFragCount: {1, 1},
+				tagSkelPos:       {start, length, start, length},
+			},
+		}
+	}
+	return indexRecords(kf8SkelTagx, entries, nil)
+}
+
+// kf8FragmentIndex lists the fragments. The label of a fragment is its insert position in the text.
+func kf8FragmentIndex(parts []*kf8Part) ([][]byte, error) {
+	cncx := new(bytes.Buffer)
+	entries := make([]indexEntry, len(parts))
+	for i, p := range parts {
+		selector := uint32(cncx.Len())
+		cncx.Write(vwiEncInt(len(p.selector)))
+		cncx.WriteString(p.selector)
+
+		entries[i] = indexEntry{
+			Label: fmt.Sprintf("%010d", p.start+p.insert),
+			Values: map[tagEntry][]uint32{
+				tagFragSelector: {selector},
+				tagFragFileNum:  {uint32(i)},
+				tagFragSeqNum:   {uint32(i)},
+				tagFragPos:      {0, uint32(len(p.fragment))},
+			},
+		}
+	}
+	return indexRecords(kf8FragTagx, entries, cncx.Bytes())
+}
+
+// kf8NcxIndex lists the chapters breadth first, as the MOBI6 NCX does, pointing to their fragments with pos:fid
+func (w *mobiBuilder) kf8NcxIndex(parts []*kf8Part) ([][]byte, error) {
+	fids := make(map[*mobiChapter]int, len(parts))
+	for i, p := range parts {
+		fids[p.chapter] = i
+	}
+
+	entries, cncx := ncxEntries(w.tocNodes(), func(ch *mobiChapter) map[tagEntry][]uint32 {
+		p := parts[fids[ch]]
+		return map[tagEntry][]uint32{
+			tagEntryPos:    {uint32(p.start + p.insert)}, // Position in the text with the fragments in place
+			tagEntryLen:    {uint32(len(p.fragment))},
+			tagEntryPosFid: {uint32(fids[ch]), 0},
+		}
+	})
+	return indexRecords(kf8NcxTagx, entries, cncx)
+}
+
+// generateKF8 adds the BOUNDARY record and the KF8 part of the book. Record numbers in the KF8 header
+// are relative to KF8 record 0. Images are shared with the MOBI6 part.
+func (w *mobiBuilder) generateKF8(ctx context.Context) error {
+	parts, err := w.kf8Parts()
+	if err != nil {
+		return err
+	}
+	text, fdst := w.kf8Text(parts)
+
+	w.AddRecord([]byte(magicBoundary))
+	base := w.AddRecord([]uint8{0}).UInt32() // KF8 record 0, written once its header is complete
+	next := func() uint32 {
+		return w.RecordCount().UInt32() - base
+	}
+
+	pdh := mobiPDH{Compression: w.compression, TextLength: uint32(len(text)), RecordSize: maxRecordSize}
+	header := mobiHeader{}
+	w.setHeaderDefaults(&header)
+	header.HeaderLength = mobiHeaderKF8Len
+	header.FileVersion = 8
+	header.MinVersion = 8
+	ext := mobiHeaderKF8{DatpIndex: uint32Max, GuideIndex: uint32Max}
+
+	records, huff, err := w.textRecords(ctx, text, nil)
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		w.AddRecord(records[i])
+	}
+	if len(records) > maxRecordCount {
+		return errors.New("KF8 part has more than 65535 text records")
+	}
+	pdh.RecordCount = uint16(len(records))
+
+	w.AddRecord([]uint8{0, 0})
+	header.FirstNonBookIndex = next()
+
+	if huff != nil {
+		header.HuffmanRecordOffset = next()
+		w.AddRecord(huff.huffRecord())
+		for _, cdic := range huff.cdicRecords() {
+			w.AddRecord(cdic)
+		}
+		header.HuffmanRecordCount = next() - header.HuffmanRecordOffset
+	}
+
+	w.report(StageIndex, 0, len(parts))
+	indexes := []struct {
+		offset  *uint32
+		records func([]*kf8Part) ([][]byte, error)
+	}{
+		{&ext.FragmentIndex, kf8FragmentIndex},
+		{&ext.SkeletonIndex, kf8SkeletonIndex},
+		{&header.IndxRecodOffset, w.kf8NcxIndex},
+	}
+	for _, index := range indexes {
+		records, err := index.records(parts)
+		if err != nil {
+			return err
+		}
+		*index.offset = next()
+		for _, rec := range records {
+			w.AddRecord(rec)
+		}
+	}
+	w.report(StageIndex, len(parts), len(parts))
+
+	// The FDST record number takes the place of FirstContentRecordNumber and LastContentRecordNumber
+	fdstIndex := next()
+	header.FirstContentRecordNumber = uint16(fdstIndex >> 16)
+	header.LastContentRecordNumber = uint16(fdstIndex)
+	header.Unknown6 = uint32(len(fdst))
+	w.AddRecord(generateFdst(fdst))
+
+	// Images precede the KF8 part, so their (32 bit) relative record number wraps around
+	header.FirstImageIndex = uint32Max
+	if w.Header.FirstImageIndex != uint32Max {
+		header.FirstImageIndex = w.Header.FirstImageIndex - base
+	}
+
+	header.FlisRecordIndex = w.AddRecord(w.generateFlis()).UInt32() - base
+	header.FcisRecordIndex = w.AddRecord(w.generateFcis(pdh.TextLength)).UInt32() - base
+
+	w.log().Debug("KF8 part", "record0", base, "text_records", pdh.RecordCount, "parts", len(parts), "flows", len(fdst))
+
+	rec, err := w.kf8Record0(pdh, header, ext)
+	if err != nil {
+		return err
+	}
+	w.records[base] = rec
+	return w.Exth.Add(EXTH_KF8BOUNDARY, base)
+}
+
+// kf8Record0 writes the record 0 of the KF8 part. It carries the EXTH records of the book, except for the boundary.
+func (w *mobiBuilder) kf8Record0(pdh mobiPDH, header mobiHeader, ext mobiHeaderKF8) ([]byte, error) {
+	exth := mobiExth{}
+	for _, rec := range w.Exth.Records {
+		if rec.RecordType != EXTH_KF8BOUNDARY {
+			exth.Records = append(exth.Records, rec)
+		}
+	}
+
+	header.FullNameLength = uint32(len(w.title))
+	header.FullNameOffset = uint32(palmDocHeaderLen + mobiHeaderKF8Len + exth.GetHeaderLenght() + 1)
+
+	buf := new(bytes.Buffer)
+	bw := &binaryWriter{out: buf}
+	for _, v := range []interface{}{pdh, header, ext} {
+		if _, err := bw.writeBinary(v); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeExth(bw, &exth); err != nil {
+		return nil, err
+	}
+	if _, err := bw.pad(1); err != nil {
+		return nil, err
+	}
+	if _, err := bw.Write([]byte(w.title)); err != nil {
+		return nil, err
+	}
+
+	// Leave room for EXTH records added by third party tools, as the MOBI6 record 0 does
+	if _, err := bw.seekForwardTo(1024 * 10); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// generateFdst writes the FDST record, listing the start and end of every flow
+func generateFdst(fdst []mobiFdstEntry) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(magicFdst.String())
+	binary.Write(buf, binary.BigEndian, uint32(12))
+	binary.Write(buf, binary.BigEndian, uint32(len(fdst)))
+	binary.Write(buf, binary.BigEndian, fdst)
+	return buf.Bytes()
+}
@@ -0,0 +1,47 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"testing"
+)
+
+func TestKF8PartsWellFormed(t *testing.T) {
+	m := NewBuilder()
+	m.Title("Q&A")
+	m.KF8(true)
+	m.NewChapter("Questions & <Answers>", []byte("<p>Text</p>"))
+
+	out := new(bytes.Buffer)
+	if _, err := m.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	parts, err := openTestBook(t, out.Bytes()).KF8Parts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, part := range parts {
+		d := xml.NewDecoder(bytes.NewReader(part))
+		for {
+			if _, err = d.Token(); err != nil {
+				break
+			}
+		}
+		if err != io.EOF {
+			t.Errorf("Part %d is not well-formed: %v\n%s", i, err, part)
+		}
+	}
+	if !bytes.Contains(parts[0], []byte("<h1>Questions &amp; &lt;Answers&gt;</h1>")) {
+		t.Errorf("Title was not escaped: %s", parts[0])
+	}
+
+	// The MOBI6 text escapes the titles too
+	raw, err := openTestBook(t, out.Bytes()).RawML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, []byte("<h1>Questions &amp; &lt;Answers&gt;</h1>")) || bytes.Contains(raw, []byte("<Answers>")) {
+		t.Errorf("Title was not escaped in the MOBI6 text: %s", raw)
+	}
+}
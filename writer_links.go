@@ -0,0 +1,219 @@
+package mobi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Links are rewritten to filepos attributes of fixed width, so the offsets of the text can be computed before they are written
+const fileposFormat = "filepos=%010d"
+
+// Matches the href attribute of <a> tags. The attribute value is quoted with " or ', or not quoted at all.
+var linkHrefRegexp = regexp.MustCompile(`(?is)<a\s[^>]*?\b(href\s*=\s*("[^"]*"|'[^']*'|[^\s>]+))`)
+
+// Match the tags of the text and their id and name attributes. Anchors point at the start of their tag.
+var anchorTagRegexp = regexp.MustCompile(`(?s)<[a-zA-Z][^>]*>`)
+var anchorAttrRegexp = regexp.MustCompile(`(?is)\s(?:id|name)\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+
+// htmlLink is an internal link of the book HTML
+type htmlLink struct {
+	start, end int    // Position of the href attribute
+	file       string // File name of the target chapter, empty for links within the chapter
+	fragment   string
+}
+
+// linkPart is a part of the book HTML: the text of a chapter without its sub-chapters,
+// or the text before and after the chapters
+type linkPart struct {
+	chapter *mobiChapter // Nil for the text outside of the chapters
+	text    []byte
+	links   []htmlLink
+}
+
+// resolveLinks rewrites the internal links of the book HTML to filepos offsets. Links are either
+// "#id" anchors, or "file.html#id" links to chapters with a file name set by SetFileName. Links to
+// the file alone point at the start of the chapter. Links with a URL scheme are left as they are.
+// The offsets of the chapters are updated for the rewritten text.
+func (w *mobiBuilder) resolveLinks(text []byte) ([]byte, error) {
+	chapters := w.allChapters()
+	r := newLinkResolver(chapters, fileposLink)
+
+	// Chapters follow each other in reading order, sub-chapters follow the text of their parent
+	var parts []linkPart
+	pos := 0
+	for _, ch := range chapters {
+		if ch.RecordOffset > pos {
+			parts = append(parts, linkPart{text: text[pos:ch.RecordOffset]})
+		}
+		parts = append(parts, linkPart{chapter: ch, text: text[ch.RecordOffset : ch.RecordOffset+ch.Len]})
+		pos = ch.RecordOffset + ch.Len
+	}
+	parts = append(parts, linkPart{text: text[pos:]})
+
+	// All anchors must be known before the first link is rewritten
+	pos = 0
+	for i := range parts {
+		p := &parts[i]
+		var err error
+		if p.links, err = r.findLinks(p.text); err != nil {
+			return nil, err
+		}
+		n := r.addAnchors(p.text, p.links, p.chapter, pos)
+		if p.chapter != nil {
+			p.chapter.RecordOffset, p.chapter.Len = pos, n
+		}
+		pos += n
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, pos))
+	for _, p := range parts {
+		if err := r.rewrite(out, p.text, p.links, p.chapter); err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// fileposLink returns the attribute of a link to offset pos of the MOBI6 text
+func fileposLink(pos int) string {
+	return fmt.Sprintf(fileposFormat, pos)
+}
+
+// linkResolver finds the targets of links, from the anchors of the text laid out so far
+type linkResolver struct {
+	files   map[string]*mobiChapter // Chapters by the file name set by SetFileName
+	anchors map[string][]int        // Positions of the anchors in the rewritten text
+	spans   map[*mobiChapter][2]int // Start and end of the text of the chapters, without sub-chapters, in the rewritten text
+	link    func(pos int) string    // Attribute replacing the href attribute of a link to pos
+	width   int                     // Length of the attributes returned by link, which must not depend on pos
+}
+
+func newLinkResolver(chapters []*mobiChapter, link func(pos int) string) *linkResolver {
+	r := &linkResolver{
+		files:   make(map[string]*mobiChapter),
+		anchors: make(map[string][]int),
+		spans:   make(map[*mobiChapter][2]int),
+		link:    link,
+		width:   len(link(0)),
+	}
+	for _, ch := range chapters {
+		if ch.fileName != "" {
+			r.files[ch.fileName] = ch
+		}
+	}
+	return r
+}
+
+// findLinks returns the internal links of a part of the text
+func (r *linkResolver) findLinks(text []byte) ([]htmlLink, error) {
+	var links []htmlLink
+	for _, m := range linkHrefRegexp.FindAllSubmatchIndex(text, -1) {
+		href := string(text[m[4]:m[5]])
+		href = strings.Trim(href, `"'`)
+		u, err := url.Parse(href)
+		if err != nil || u.Scheme != "" || u.Host != "" || (u.Path == "" && u.Fragment == "") {
+			continue
+		}
+
+		link := htmlLink{start: m[2], end: m[3], file: u.Path, fragment: u.Fragment}
+		if link.file != "" && r.files[link.file] == nil {
+			return nil, errors.New("Link to unknown file " + href)
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// addAnchors records the anchors of a part of the text, which starts at pos of the rewritten text.
+// Ch is the chapter of the part, nil for the text outside of the chapters.
+// It returns the length of the part once its links are rewritten.
+func (r *linkResolver) addAnchors(text []byte, links []htmlLink, ch *mobiChapter, pos int) int {
+	shift, next := 0, 0 // Growth of the text by the links before the current tag
+	for _, tag := range anchorTagRegexp.FindAllIndex(text, -1) {
+		for ; next < len(links) && links[next].end <= tag[0]; next++ {
+			shift += r.width - (links[next].end - links[next].start)
+		}
+		for _, attr := range anchorAttrRegexp.FindAllSubmatch(text[tag[0]:tag[1]], -1) {
+			name := strings.Trim(string(attr[1]), `"'`)
+			r.anchors[name] = append(r.anchors[name], pos+tag[0]+shift)
+		}
+	}
+
+	n := len(text)
+	for _, l := range links {
+		n += r.width - (l.end - l.start)
+	}
+	if ch != nil {
+		// The text of a chapter may be laid out in several parts, which follow each other
+		span := [2]int{pos, pos + n}
+		if s, ok := r.spans[ch]; ok && s[1] == pos {
+			span[0] = s[0]
+		}
+		r.spans[ch] = span
+	}
+	return n
+}
+
+// findAnchor finds an anchor within the text of a chapter, including its sub-chapters if subtree is set,
+// or anywhere in the book if ch is nil
+func (r *linkResolver) findAnchor(name string, ch *mobiChapter, subtree bool) (int, bool) {
+	start, end := 0, math.MaxInt
+	if ch != nil {
+		start, end = r.span(ch, subtree)
+	}
+	for _, pos := range r.anchors[name] {
+		if pos >= start && pos < end {
+			return pos, true
+		}
+	}
+	return 0, false
+}
+
+// span returns the start and end of the text of a chapter, including its sub-chapters if subtree is set
+func (r *linkResolver) span(ch *mobiChapter, subtree bool) (start, end int) {
+	last := ch
+	for subtree && len(last.subChapters) > 0 {
+		last = last.subChapters[len(last.subChapters)-1]
+	}
+	return r.spans[ch][0], r.spans[last][1]
+}
+
+// rewrite writes a part of the text to out with its links rewritten. Ch is the chapter of the part,
+// nil for the text outside of the chapters. All parts must have been laid out by addAnchors.
+func (r *linkResolver) rewrite(out io.Writer, text []byte, links []htmlLink, ch *mobiChapter) error {
+	last := 0
+	for _, l := range links {
+		var pos int
+		var ok bool
+		switch {
+		case l.file != "" && l.fragment == "":
+			pos, ok = r.spans[r.files[l.file]][0], true
+		case l.file != "":
+			pos, ok = r.findAnchor(l.fragment, r.files[l.file], true)
+		default:
+			// Anchors of the linking chapter come first, as ids are only unique within a chapter
+			if pos, ok = r.findAnchor(l.fragment, ch, false); !ok {
+				pos, ok = r.findAnchor(l.fragment, nil, false)
+			}
+		}
+		if !ok {
+			return errors.New("Dangling link " + string(text[l.start:l.end]))
+		}
+
+		if _, err := out.Write(text[last:l.start]); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(out, r.link(pos)); err != nil {
+			return err
+		}
+		last = l.end
+	}
+	_, err := out.Write(text[last:])
+	return err
+}
@@ -0,0 +1,105 @@
+package mobi
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResolveLinks(t *testing.T) {
+	m := NewBuilder()
+	m.Title("Link Test")
+	m.Compression(CompressionNone)
+	m.NewChapter("Chapter 1", []byte(`<p><a href="#note">Note</a> <a href='ch2.html#fig'>Figure</a> <a href="ch2.html">Chapter 2</a> <a href="ch2.html#sec">Section</a> <a href="https://example.com">Web</a></p>`))
+	m.NewChapter("Chapter 2", []byte(`<p id="note">Note</p><div><img id=fig alt=""/></div>`)).SetFileName("ch2.html").
+		AddSubChapter("Chapter 2-1", []byte(`<p id="sec">Section</p>`))
+
+	out := new(bytes.Buffer)
+	if _, err := m.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := openTestBook(t, out.Bytes()).RawML()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := map[string]string{}
+	for _, match := range regexp.MustCompile(`filepos=(\d{10})>([^<]*)`).FindAllSubmatch(raw, -1) {
+		pos, _ := strconv.Atoi(string(match[1]))
+		targets[string(match[2])] = string(raw[pos:])
+	}
+
+	if !strings.HasPrefix(targets["Note"], `<p id="note">`) {
+		t.Errorf("Link to #note points at %.20q", targets["Note"])
+	}
+	if !strings.HasPrefix(targets["Figure"], `<img id=fig`) {
+		t.Errorf("Link to ch2.html#fig points at %.20q", targets["Figure"])
+	}
+	if !strings.HasPrefix(targets["Chapter 2"], `<a name='1'`) {
+		t.Errorf("Link to ch2.html points at %.20q", targets["Chapter 2"])
+	}
+	if !strings.HasPrefix(targets["Section"], `<p id="sec">`) {
+		t.Errorf("Link to ch2.html#sec in a sub-chapter points at %.20q", targets["Section"])
+	}
+	if !bytes.Contains(raw, []byte(`href="https://example.com"`)) {
+		t.Error("External link was rewritten")
+	}
+
+	m = NewBuilder()
+	m.Compression(CompressionNone)
+	m.NewChapter("Chapter 1", []byte(`<a href="#missing">Missing</a>`))
+	if _, err := m.WriteTo(new(bytes.Buffer)); err == nil {
+		t.Error("Dangling link did not fail the build")
+	}
+}
+
+func TestResolveKF8Links(t *testing.T) {
+	m := NewBuilder()
+	m.Title("KF8 Link Test")
+	m.KF8(true)
+	m.NewChapter("Chapter 1", []byte(`<p><a href="b.html#tgt">go</a> <a href="#loc">here</a> <a href="b.html">file</a></p><p id="loc">Here</p>`))
+	m.NewChapter("Chapter 2", []byte(`<p>Before</p>`)).SetFileName("b.html").
+		AddSubChapter("Chapter 2-1", []byte(`<p><a href="#loc">back</a></p><p id="tgt">Target</p>`))
+
+	out := new(bytes.Buffer)
+	if _, err := m.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	parts, err := openTestBook(t, out.Bytes()).KF8Parts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fragments start with the chapter title, offsets are counted from there
+	targets := map[string]string{}
+	linkRegexp := regexp.MustCompile(`href="kindle:pos:fid:([0-9A-V]{4}):off:([0-9A-V]{10})">([^<]*)`)
+	for _, part := range parts {
+		if bytes.Contains(part, []byte(`href="b.html`)) || bytes.Contains(part, []byte(`href="#`)) {
+			t.Errorf("Internal link was not rewritten: %s", part)
+		}
+		for _, match := range linkRegexp.FindAllSubmatch(part, -1) {
+			fid, _ := strconv.ParseInt(string(match[1]), 32, 0)
+			off, _ := strconv.ParseInt(string(match[2]), 32, 0)
+			target := parts[fid][bytes.Index(parts[fid], []byte("<h1>"))+int(off):]
+			targets[string(match[3])] = string(target)
+		}
+	}
+
+	expected := map[string]string{"go": `<p id="tgt">`, "here": `<p id="loc">`, "back": `<p id="loc">`, "file": `<h1>Chapter 2</h1>`}
+	for label, prefix := range expected {
+		if !strings.HasPrefix(targets[label], prefix) {
+			t.Errorf("KF8 link %q points at %.20q, expected %q", label, targets[label], prefix)
+		}
+	}
+
+	m = NewBuilder()
+	m.KF8(true)
+	m.NewChapter("Chapter 1", []byte(`<a href="#missing">Missing</a>`))
+	built := m.(*mobiBuilder).clone()
+	built.createTOCChapter()
+	if _, err := built.kf8Parts(); err == nil {
+		t.Error("Dangling link did not fail the KF8 parts")
+	}
+}
@@ -0,0 +1,280 @@
+package mobi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"runtime"
+)
+
+// WriteStream builds the book and writes it to out, compressing the text records as the text is generated.
+// Chapters are read in parts of about 64 KiB, so only a part of the text and a few records at a time are kept
+// in memory, instead of the whole text. Chapters with a source, as added by NewChapterSource or NewChapterReader,
+// are read twice: once to lay out the text and once to write it. Readers which do not implement io.Seeker
+// can only be read once, so they are kept in memory, as by NewChapterReader.
+// The record list and record 0 are written last, once the size of the text records is known, so out must be seekable.
+// The book is the same as the one written by WriteTo, but KF8 and HUFF/CDIC compression, which need the whole text
+// at once, are not supported.
+func (w *mobiBuilder) WriteStream(out io.WriteSeeker) (n int64, err error) {
+	if w.kf8 {
+		return 0, errors.New("KF8 can not be streamed")
+	}
+	if w.compression == CompressionHuffCdic {
+		return 0, errors.New("HUFF/CDIC compression can not be streamed")
+	}
+
+	w = w.clone()
+	w.createTOCChapter()
+	chapters := len(w.allChapters())
+	w.report(StageHTML, 0, chapters)
+
+	// First pass: lay out the text, so the offsets of the chapters and anchors are known before any link is written
+	links := newLinkResolver(w.allChapters(), fileposLink)
+	images := make(map[string]int)
+	textLen := 0
+	err = w.eachTextPart(images, func(ch *mobiChapter, text []byte) error {
+		found, err := links.findLinks(text)
+		if err != nil {
+			return err
+		}
+		textLen += links.addAnchors(text, found, ch, textLen)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, ch := range w.allChapters() {
+		span := links.spans[ch]
+		ch.RecordOffset, ch.Len = span[0], span[1]-span[0]
+	}
+	w.report(StageHTML, chapters, chapters)
+
+	// Text records are left empty, they are written while streaming
+	w.timestamp = uint32(w.buildTime().Unix())
+	w.AddRecord([]uint8{0})
+	w.Pdh.TextLength = uint32(textLen)
+	textRecords := (textLen + maxRecordSize - 1) / maxRecordSize
+	for i := 0; i < textRecords; i++ {
+		w.AddRecord(nil)
+	}
+	if err := w.addNonTextRecords(context.Background()); err != nil {
+		return 0, err
+	}
+
+	// Room for the record list and record 0, whose size does not depend on the text
+	rec0, err := w.record0()
+	if err != nil {
+		return 0, err
+	}
+	bw := &binaryWriter{out: out}
+	if _, err := bw.pad(uint(recordListEnd(len(w.records)) + len(rec0))); err != nil {
+		return bw.written(), err
+	}
+
+	// Second pass: write the text records
+	textHash := w.textHash()
+	tw := &textRecordWriter{builder: w, out: bw, total: textRecords, tbs: tbsSequences(w.chapters, textLen)}
+	w.report(StageCompression, 0, textRecords)
+	err = w.eachTextPart(images, func(ch *mobiChapter, text []byte) error {
+		found, err := links.findLinks(text)
+		if err != nil {
+			return err
+		}
+		return links.rewrite(io.MultiWriter(textHash, tw), text, found, ch)
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		return bw.written(), err
+	}
+	if tw.textLen != textLen {
+		return bw.written(), errors.New("Text changed while the book was written")
+	}
+	w.log().Debug("Streamed text records", "count", textRecords, "text_length", textLen)
+
+	sizes := make([]int, len(w.records))
+	sizes[0] = len(rec0)
+	copy(sizes[1:], tw.sizes)
+	for i := 1 + textRecords; i < len(w.records); i++ {
+		if _, err := bw.Write(w.records[i]); err != nil {
+			return bw.written(), err
+		}
+		sizes[i] = len(w.records[i])
+	}
+
+	// Go back to write the record list and record 0
+	w.Pdf.UniqueIDSeed = w.uniqueID(textHash)
+	if rec0, err = w.record0(); err != nil {
+		return bw.written(), err
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return bw.written(), err
+	}
+	head := &binaryWriter{out: out}
+	if err := writeRecordList(head, w.Pdf, sizes); err != nil {
+		return bw.written(), err
+	}
+	if _, err := head.Write(rec0); err != nil {
+		return bw.written(), err
+	}
+	if _, err := out.Seek(bw.written(), io.SeekStart); err != nil {
+		return bw.written(), err
+	}
+	w.log().Debug("Built book", "records", w.Pdf.RecordsNum, "exth_records", len(w.Exth.Records), "unique_id", w.Pdf.UniqueIDSeed)
+	return bw.written(), nil
+}
+
+// textPartSize is the size of the parts the chapters are read in by WriteStream
+const textPartSize = 64 * 1024
+
+// eachTextPart calls fn with the parts of the book HTML in order: the head, the text of each chapter
+// without its sub-chapters, and the end. The content of the chapters is read from their source, if they have one,
+// and their images are embedded with embedTextImages.
+func (w *mobiBuilder) eachTextPart(images map[string]int, fn func(ch *mobiChapter, text []byte) error) error {
+	if err := fn(nil, w.htmlHead()); err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	for _, ch := range w.allChapters() {
+		buf.Reset()
+		if err := w.eachChapterPart(ch, buf, images, fn); err != nil {
+			return err
+		}
+	}
+	return fn(nil, []byte(htmlFoot))
+}
+
+// eachChapterPart calls fn with the text of a chapter, without its sub-chapters, in parts of about textPartSize bytes.
+// Parts end after a '>', so that no tag is cut in two.
+func (w *mobiBuilder) eachChapterPart(ch *mobiChapter, buf *bytes.Buffer, images map[string]int, fn func(ch *mobiChapter, text []byte) error) (err error) {
+	rc, err := ch.open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := rc.Close(); err == nil && closeErr != nil {
+			err = errors.New("Can not read chapter " + ch.title + ": " + closeErr.Error())
+		}
+	}()
+
+	ch.writeHTMLStart(buf)
+	for {
+		n, err := buf.ReadFrom(io.LimitReader(rc, textPartSize))
+		if err != nil {
+			return errors.New("Can not read chapter " + ch.title + ": " + err.Error())
+		}
+		last := n < textPartSize
+		if last {
+			buf.WriteString(chapterEnd)
+		}
+
+		text := buf.Bytes()
+		end := len(text)
+		if !last {
+			// Text without any tag end is read on until there is one
+			if end = bytes.LastIndexByte(text, '>') + 1; end == 0 {
+				continue
+			}
+		}
+		part, err := w.embedTextImages(text[:end], images)
+		if err != nil {
+			return err
+		}
+		if err := fn(ch, part); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		buf.Next(end)
+	}
+}
+
+// textRecordWriter cuts the text written to it into text records, which are compressed and written to out in batches
+type textRecordWriter struct {
+	builder *mobiBuilder
+	out     *binaryWriter
+	buf     []byte // Text not cut into records yet
+	textLen int    // Bytes of text written so far
+
+	chunks   [][]byte // Records waiting to be compressed
+	overlaps [][]byte
+	tbs      [][]byte // Trailing byte sequences of all records
+	sizes    []int    // Sizes of the records written so far
+
+	compressed, total int // Records compressed so far and in all, for progress reports
+}
+
+// Write adds text. Records are cut once the bytes following them, which may continue a multibyte character, are known.
+func (t *textRecordWriter) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	t.textLen += len(p)
+	text := t.buf
+	for len(text) >= maxRecordSize+3 {
+		if err := t.cut(text, maxRecordSize); err != nil {
+			return 0, err
+		}
+		text = text[maxRecordSize:]
+	}
+	// The text left is moved to the start of the buffer once, not after every record
+	t.buf = append(t.buf[:0], text...)
+	return len(p), nil
+}
+
+// Close writes the remaining text records
+func (t *textRecordWriter) Close() error {
+	for text := t.buf; len(text) > 0; {
+		n := len(text)
+		if n > maxRecordSize {
+			n = maxRecordSize
+		}
+		if err := t.cut(text, n); err != nil {
+			return err
+		}
+		text = text[n:]
+	}
+	t.buf = t.buf[:0]
+	return t.flush()
+}
+
+// cut moves the first n bytes of text to the records waiting to be compressed
+func (t *textRecordWriter) cut(text []byte, n int) error {
+	t.chunks = append(t.chunks, append([]byte(nil), text[:n]...))
+	t.overlaps = append(t.overlaps, append([]byte(nil), multibyteOverlap(text[n:])...))
+
+	// A few records per worker keep the workers busy
+	workers := t.builder.workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	if len(t.chunks) >= workers*4 {
+		return t.flush()
+	}
+	return nil
+}
+
+// flush compresses the waiting records and writes them
+func (t *textRecordWriter) flush() error {
+	if len(t.sizes)+len(t.chunks) > len(t.tbs) {
+		return errors.New("Text changed while the book was written")
+	}
+	tbs := t.tbs[len(t.sizes) : len(t.sizes)+len(t.chunks)]
+	records, err := t.builder.compressChunks(context.Background(), t.chunks, t.overlaps, tbs, nil, func() {
+		t.compressed++
+		t.builder.report(StageCompression, t.compressed, t.total)
+	})
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if _, err := t.out.Write(rec); err != nil {
+			return err
+		}
+		t.sizes = append(t.sizes, len(rec))
+	}
+	t.chunks, t.overlaps = t.chunks[:0], t.overlaps[:0]
+	return nil
+}
@@ -0,0 +1,115 @@
+package mobi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteStream(t *testing.T) {
+	text := strings.Repeat("<p>"+lipsum+" ÆØÅ – “quoted” ✓</p>", 6)
+	for _, compression := range []mobiPDHCompression{CompressionNone, CompressionPalmDoc} {
+		m := NewBuilder()
+		m.Title("Stream Test")
+		m.Compression(compression)
+		m.Timestamp(time.Unix(1500000000, 0))
+		m.Workers(1) // Several batches of records
+		ch := m.NewChapter("Chapter 1", []byte(`<p><a href="ch2.html#end">End</a> <img src="data:image/gif;base64,R0lGODlhAQABAAAAACw="></p>`+text))
+		ch.AddSubChapter("Chapter 1-1", []byte(text+`<a href="#start">Start</a>`))
+		m.NewChapter("Chapter 2", []byte(`<p id="start">`+text+`</p><p id="end"></p>`)).SetFileName("ch2.html")
+
+		expected := new(bytes.Buffer)
+		if _, err := m.WriteTo(expected); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Create(filepath.Join(t.TempDir(), "stream.mobi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		n, err := m.WriteStream(f)
+		if err != nil {
+			t.Fatalf("compression %d: %v", compression, err)
+		}
+		actual, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(actual)) || !bytes.Equal(actual, expected.Bytes()) {
+			t.Errorf("compression %d: streamed book (%d bytes, %d reported) differs from the built one (%d bytes)", compression, len(actual), n, expected.Len())
+		}
+	}
+
+	m := NewBuilder()
+	m.KF8(true)
+	m.NewChapter("Chapter 1", []byte("Text"))
+	f, err := os.Create(filepath.Join(t.TempDir(), "kf8.mobi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := m.WriteStream(f); err == nil {
+		t.Error("KF8 book was streamed")
+	}
+}
+
+func TestWriteStreamLargeChapters(t *testing.T) {
+	// Links, anchors and images all along chapters longer than a part, read from readers which can not seek
+	var text strings.Builder
+	for i := 0; text.Len() < 3*textPartSize; i++ {
+		fmt.Fprintf(&text, `<p id="p%d"><a href="#p%d">Back</a> <img src="data:image/gif;base64,R0lGODlhAQABAAAAACw="> %s ✓</p>`, i, i/2, lipsum)
+	}
+	m := NewBuilder()
+	m.Title("Large Stream Test")
+	m.Timestamp(time.Unix(1500000000, 0))
+	m.NewChapterReader("Chapter 1", struct{ io.Reader }{strings.NewReader(text.String())})
+	m.NewChapterReader("Chapter 2", struct{ io.Reader }{strings.NewReader(`<a href="#p3">` + text.String())})
+
+	expected := new(bytes.Buffer)
+	if _, err := m.WriteTo(expected); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "stream.mobi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := m.WriteStream(f); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, expected.Bytes()) {
+		t.Errorf("Streamed book (%d bytes) differs from the built one (%d bytes)", len(actual), expected.Len())
+	}
+
+	// Chapters are read in parts, which join into the text of the chapter
+	b := m.(*mobiBuilder)
+	ch := b.chapters[0]
+	full := new(bytes.Buffer)
+	ch.writeHTML(full, []byte(text.String()))
+	parts := new(bytes.Buffer)
+	count := 0
+	err = b.eachChapterPart(ch, new(bytes.Buffer), map[string]int{}, func(_ *mobiChapter, part []byte) error {
+		if len(part) > 2*textPartSize {
+			t.Errorf("Part of %d bytes", len(part))
+		}
+		parts.Write(part)
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count < 3 || !bytes.Equal(bytes.ReplaceAll(parts.Bytes(), []byte(`recindex="00001"`), []byte(`src="data:image/gif;base64,R0lGODlhAQABAAAAACw="`)), full.Bytes()) {
+		t.Errorf("Chapter of %d bytes read in %d parts of %d bytes", full.Len(), count, parts.Len())
+	}
+}
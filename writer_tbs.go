@@ -0,0 +1,90 @@
+package mobi
+
+// Flags of the first value of a trailing byte sequence (TBS), which holds the index of the first NCX entry of a record
+// above its flags. Books use 3 flag bits, periodicals 4.
+const (
+	tbsFlagSpans  = 0b001 // The entry starts before the record and ends after it, followed by a value
+	tbsFlagOffset = 0b010 // Followed by an offset, 0 for books
+	tbsFlagCount  = 0b100 // Followed by a byte holding the number of entries in the record
+	tbsFlagBits   = 3
+)
+
+// Extra record data flags of MOBI6 text records: the multibyte overlap and the TBS
+const extraDataMultibyte, extraDataTBS = 0b01, 0b10
+
+// tbsSequences returns the trailing byte sequence of every text record of a text of textLen bytes. It lists the
+// top level NCX entries found in the record, which Kindle uses to move between chapters. Chapters are the top level
+// chapters, in the order of the NCX index, and extend up to the next one.
+func tbsSequences(chapters []*mobiChapter, textLen int) [][]byte {
+	sequences := make([][]byte, (textLen+maxRecordSize-1)/maxRecordSize)
+	first := 0 // First chapter which does not end before the record
+	for i := range sequences {
+		start, end := i*maxRecordSize, (i+1)*maxRecordSize
+		chapterEnd := func(n int) int {
+			if n+1 < len(chapters) {
+				return chapters[n+1].RecordOffset
+			}
+			return textLen
+		}
+		for first < len(chapters) && chapterEnd(first) <= start {
+			first++
+		}
+
+		var count, complete int
+		spans := false
+		for n := first; n < len(chapters) && chapters[n].RecordOffset < end; n++ {
+			startsIn, endsIn := chapters[n].RecordOffset >= start, chapterEnd(n) <= end
+			switch {
+			case startsIn && endsIn:
+				complete++
+			case !startsIn && !endsIn:
+				spans = true
+			}
+			count++
+		}
+		sequences[i] = encodeTBS(first, count, complete, spans)
+	}
+	return sequences
+}
+
+// encodeTBS encodes the trailing byte sequence of a record holding count entries from index first,
+// complete of which start and end in the record
+func encodeTBS(first, count, complete int, spans bool) []byte {
+	switch {
+	case count == 0:
+		return []byte{} // Still written as an empty entry
+	case spans:
+		tbs := vwiEncInt(first<<tbsFlagBits | tbsFlagOffset | tbsFlagSpans)
+		tbs = append(tbs, vwiEncInt(0)...)
+		return append(tbs, vwiEncInt(0)...)
+	case count == 1 && complete == 0:
+		// A single chapter starting or ending in the record
+		return append(vwiEncInt(first<<tbsFlagBits|tbsFlagOffset), vwiEncInt(0)...)
+	}
+
+	if count > 0xFF {
+		count = 0xFF
+	}
+	tbs := vwiEncInt(first<<tbsFlagBits | tbsFlagOffset | tbsFlagCount)
+	tbs = append(tbs, vwiEncInt(0)...)
+	return append(tbs, byte(count))
+}
+
+// trailingEntry appends the size of a trailing entry to its data. The size includes itself, and is encoded
+// backwards, so it can be read from the end of the record.
+func trailingEntry(data []byte) []byte {
+	for n := 1; ; n++ {
+		size := vwiEncIntBackward(len(data) + n)
+		if len(size) == n {
+			return append(append([]byte(nil), data...), size...)
+		}
+	}
+}
+
+// vwiEncIntBackward encodes X as a variable width integer which is read backwards: the high bit marks its first byte
+func vwiEncIntBackward(x int) []byte {
+	enc := vwiEncInt(x)
+	enc[len(enc)-1] &= 0x7F
+	enc[0] |= 0x80
+	return enc
+}
@@ -0,0 +1,32 @@
+package mobi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTBSSequences(t *testing.T) {
+	chapters := []*mobiChapter{{RecordOffset: 0}, {RecordOffset: 100}, {RecordOffset: 200}, {RecordOffset: 3*maxRecordSize + 10}}
+	expected := [][]byte{
+		{0x86, 0x80, 0x03, 0x84}, // Chapters 0 and 1 complete, chapter 2 starts
+		{0x93, 0x80, 0x80, 0x84}, // Chapter 2 spans the record
+		{0x93, 0x80, 0x80, 0x84},
+		{0x96, 0x80, 0x02, 0x84}, // Chapter 2 ends, chapter 3 starts
+		{0x9A, 0x80, 0x83},       // Chapter 3 ends
+	}
+
+	sequences := tbsSequences(chapters, 5*maxRecordSize)
+	if len(sequences) != len(expected) {
+		t.Fatalf("Expected %d sequences, got %d", len(expected), len(sequences))
+	}
+	for i, seq := range sequences {
+		if entry := trailingEntry(seq); !bytes.Equal(entry, expected[i]) {
+			t.Errorf("Record %d has trailing entry % X, expected % X", i+1, entry, expected[i])
+		}
+	}
+
+	// Records without a chapter still have an empty entry
+	if entry := trailingEntry(encodeTBS(0, 0, 0, false)); !bytes.Equal(entry, []byte{0x81}) {
+		t.Errorf("Empty trailing entry is % X", entry)
+	}
+}
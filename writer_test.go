@@ -0,0 +1,174 @@
+package mobi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildRepeatable(t *testing.T) {
+	m := NewBuilder()
+	m.Title("Repeatable")
+	m.Compression(CompressionPalmDoc)
+	m.NewExthRecord(EXTH_AUTHOR, "Book Author")
+	m.NewChapter("Chapter 1", []byte(`<p>Text <img src="data:image/gif;base64,R0lGODlhAQABAAAAACw="></p>`))
+	m.KF8(true)
+
+	book, err := m.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := new(bytes.Buffer), new(bytes.Buffer)
+	if n, err := book.WriteTo(first); err != nil || n != book.Size() {
+		t.Fatalf("Wrote %d of %d bytes: %v", n, book.Size(), err)
+	}
+	book.WriteTo(second)
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("Writing the same book twice gave different output")
+	}
+
+	// Building again gives the same book, apart from the timestamps
+	again, err := m.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Size() != book.Size() || len(again.records) != len(book.records) {
+		t.Errorf("Second build differs: %d records of %d bytes, expected %d of %d", len(again.records), again.Size(), len(book.records), book.Size())
+	}
+
+	r := openTestBook(t, first.Bytes())
+	toc, err := r.TOC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toc) != 2 || len(m.Chapters()) != 1 {
+		t.Errorf("Build changed the chapters: %d TOC entries, %d chapters", len(toc), len(m.Chapters()))
+	}
+	if authors := r.exthStrings(EXTH_AUTHOR); len(authors) != 1 {
+		t.Errorf("Unexpected authors %v", authors)
+	}
+}
+
+// failingWriter fails once more than limit bytes are written
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		return 0, errors.New("Disk full")
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestBuilderErrors(t *testing.T) {
+	dir := t.TempDir()
+	cover := filepath.Join(dir, "cover.jpg")
+	os.WriteFile(cover, []byte{0xFF, 0xD8, 0xFF, 0xE0}, 0644)
+
+	m := NewBuilder()
+	if err := m.AddCover(cover, filepath.Join(dir, "missing.jpg")); err == nil || !strings.Contains(err.Error(), "missing.jpg") {
+		t.Errorf("Missing thumbnail gave error %v", err)
+	}
+	if err := m.NewExthRecord(EXTH_COVEROFFSET, "not a number"); err == nil {
+		t.Error("String value was accepted for a numeric record")
+	}
+	if err := m.NewExthRecord(EXTH_TAMPERKEYS, "not binary"); err == nil {
+		t.Error("String value was accepted for a binary record")
+	}
+	if err := m.NewExthRecord(EXTH_AUTHOR, 42); err == nil {
+		t.Error("Integer value was accepted for a string record")
+	}
+	if err := m.Compression(mobiPDHCompression(99)); err == nil {
+		t.Error("Unknown compression was accepted")
+	}
+
+	var id [3]byte
+	if err := magicIndx.WriteTo(&id); err == nil {
+		t.Error("Magic was written to a smaller array")
+	}
+
+	m.NewChapter("Chapter 1", []byte("Some text here"))
+	book, err := m.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := book.WriteTo(&failingWriter{limit: 100}); err == nil || n > 100 {
+		t.Errorf("Write error was not returned: wrote %d bytes, error %v", n, err)
+	}
+}
+
+func TestReproducibleBuild(t *testing.T) {
+	build := func(isbn string, setup func(m Builder)) []byte {
+		m := NewBuilder()
+		m.Title("Reproducible")
+		m.NewExthRecord(EXTH_ISBN, isbn)
+		m.NewChapter("Chapter 1", []byte("Some text here"))
+		m.KF8(true)
+		setup(m)
+
+		out := new(bytes.Buffer)
+		if _, err := m.WriteTo(out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Bytes()
+	}
+
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fixed := func(m Builder) { m.Timestamp(stamp) }
+	first, second := build("9780000000002", fixed), build("9780000000002", fixed)
+	if !bytes.Equal(first, second) {
+		t.Error("Builds with the same timestamp differ")
+	}
+
+	r := openTestBook(t, first)
+	if r.mobi.Pdf.CreationTime != uint32(stamp.Unix()) || r.mobi.Pdf.ModificationTime != uint32(stamp.Unix()) {
+		t.Errorf("Unexpected timestamps %d, %d", r.mobi.Pdf.CreationTime, r.mobi.Pdf.ModificationTime)
+	}
+
+	other := openTestBook(t, build("9780000000019", fixed))
+	if other.mobi.Header.UniqueID == r.mobi.Header.UniqueID {
+		t.Error("Books with different ISBNs have the same unique ID")
+	}
+	byID := openTestBook(t, build("9780000000019", func(m Builder) { m.DocumentID("catalogue-1") }))
+	if byID.mobi.Header.UniqueID == other.mobi.Header.UniqueID {
+		t.Error("Document ID was not used for the unique ID")
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "1500000000")
+	epoch := openTestBook(t, build("9780000000002", func(Builder) {}))
+	if epoch.mobi.Pdf.CreationTime != 1500000000 {
+		t.Errorf("SOURCE_DATE_EPOCH was not used: %d", epoch.mobi.Pdf.CreationTime)
+	}
+}
+
+func TestRecordLimit(t *testing.T) {
+	m := NewBuilder().(*mobiBuilder)
+	m.NewChapter("Chapter 1", []byte("Some text here"))
+
+	// Record 0 and the text records, left empty
+	withTextRecords := func(n int) *mobiBuilder {
+		w := m.clone()
+		w.createTOCChapter()
+		for i := 0; i <= n; i++ {
+			w.AddRecord(nil)
+		}
+		return w
+	}
+	if err := withTextRecords(maxRecordCount + 1).addNonTextRecords(context.Background()); err == nil || !strings.Contains(err.Error(), "text records") {
+		t.Errorf("Too many text records gave error %v", err)
+	}
+	if err := withTextRecords(maxRecordCount - 1).addNonTextRecords(context.Background()); err == nil || !strings.Contains(err.Error(), "65535 records") {
+		t.Errorf("Too many records gave error %v", err)
+	}
+	if err := writeRecordList(&binaryWriter{out: io.Discard}, mobiPDF{}, make([]int, maxRecordCount+1)); err == nil {
+		t.Error("Record list of more than 65535 records was written")
+	}
+}